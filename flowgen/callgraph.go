@@ -0,0 +1,104 @@
+package flowgen
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// ==========================================
+// CALL GRAPH
+// ==========================================
+
+// callGraphs draws, for each loaded package, which of its functions call
+// which: one node per function, one edge per caller and callee however
+// often the call is made. Calls made inside function literals count for
+// the function declaring them. Functions nothing else in the package
+// calls, its entry points, are styled as roots.
+func callGraphs(pkgs []*packages.Package, opts Options, th *theme, redact *redactor, emit emitFunc) error {
+	byPkg := make(map[*packages.Package][]target)
+	var order []*packages.Package
+	for _, t := range allFunctions(pkgs) {
+		if t.Pkg.TypesInfo == nil {
+			continue
+		}
+		if byPkg[t.Pkg] == nil {
+			order = append(order, t.Pkg)
+		}
+		byPkg[t.Pkg] = append(byPkg[t.Pkg], t)
+	}
+	if len(order) == 0 {
+		return fmt.Errorf("-callgraph needs type information; no functions with bodies found in type-checked packages in %s", opts.Dir)
+	}
+
+	for i, pkg := range order {
+		d := &diagram{Direction: opts.Direction, Theme: th}
+		ids := make(map[*types.Func]string)
+		for i, t := range byPkg[pkg] {
+			if fn, ok := pkg.TypesInfo.Defs[t.Decl.Name].(*types.Func); ok {
+				ids[fn] = fmt.Sprintf("F%d", i+1)
+			}
+		}
+
+		called := make(map[string]bool)
+		for i, t := range byPkg[pkg] {
+			from := fmt.Sprintf("F%d", i+1)
+			name, _ := redact.name(t)
+			n := d.addNode(from, name, shapeBox, "")
+			if opts.Tooltips {
+				n.Tooltip = fmt.Sprint(pkg.Fset.Position(t.Decl.Pos()))
+			}
+			seen := make(map[string]bool)
+			ast.Inspect(t.Decl.Body, func(x ast.Node) bool {
+				call, ok := x.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				if fn := calleeOf(call, pkg.TypesInfo); fn != nil {
+					if to, ok := ids[fn]; ok && !seen[to] {
+						seen[to] = true
+						d.addEdge(&edge{From: from, To: to})
+						if to != from {
+							called[to] = true
+						}
+					}
+				}
+				return true
+			})
+		}
+		for _, n := range d.Nodes {
+			if !called[n.ID] {
+				n.Class = "root"
+			}
+		}
+
+		if opts.Validate {
+			if err := validateMermaid(d); err != nil {
+				return fmt.Errorf("call graph of %s: invalid Mermaid: %v", pkg.Name, err)
+			}
+		}
+		write := func(w io.Writer) error {
+			bw := bufio.NewWriter(w)
+			if err := render(bw, d, opts); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		name, path := pkg.Name, pkg.PkgPath
+		if path == "" {
+			path = pkg.Name
+		}
+		if redact != nil {
+			name = redact.pkg(path, pkg.Name)
+			path = name
+		}
+		if err := emit(Result{Name: name, Package: path}, i, len(order), write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,794 @@
+package flowgen
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ==========================================
+// DIAGRAM MODEL
+// ==========================================
+
+// analyzeCFG describes the flow as a format-neutral diagram; the renderers
+// in mermaid.go and dot.go turn it into text. Labels use "\n" for line
+// breaks and each renderer translates them to its own syntax.
+
+type shape int
+
+const (
+	shapeBox shape = iota
+	shapeDiamond
+	shapeCircle
+	shapeStadium
+	shapeSubroutine    // a box with double sides, for calls
+	shapeParallelogram // for channel sends and receives
+)
+
+type node struct {
+	ID           string
+	Label        string
+	Shape        shape
+	Class        string
+	ExtraClasses []string // applied on top of Class, e.g. "highlight"
+	Note         string   // source comments, drawn in italics under the label
+	Tooltip      string   // full source of the statements, shown on hover
+}
+
+type edge struct {
+	From    string
+	To      string
+	Label   string
+	Back    bool // jumps backwards in the flow (loop), drawn dashed
+	Long    bool // loop exit, drawn longer so it clears the loop body
+	Call    bool // from a call site into an expanded callee, drawn thick
+	Panic   bool // into the PANIC exit, drawn red
+	Recover bool // from the PANIC exit to a deferred recover, or from a recovered panic, drawn dashed
+	Aside   bool // to a side note rather than a step in the flow, drawn dotted
+	Fork    bool // to a goroutine started here, which runs apart from the flow
+	Recurse bool // from a recursive call back to the function's ROOT, drawn dashed
+}
+
+// flow reports whether the edge is a step of the function's own flow, as
+// opposed to pointing at a note or a goroutine off to the side.
+func (e *edge) flow() bool {
+	return !e.Aside && !e.Fork
+}
+
+// subgraph groups nodes under a titled frame: an expanded callee or a
+// loop body. Subgraphs nest when one's nodes contain another's.
+type subgraph struct {
+	ID     string
+	Label  string
+	Nodes  []string
+	Parent *subgraph
+}
+
+type diagram struct {
+	Direction string // TD, LR, BT or RL
+	Theme     *theme // colors; nil means the light theme
+	Nodes     []*node
+	Edges     []*edge
+	Subgraphs []*subgraph
+
+	Complexity int      // cyclomatic complexity of the analyzed function
+	Comments   []string // written as comments at the top of the output
+	Packages   []string // packages -color-by-package gave a class, "pkg_" + name, in the theme
+	Entries    []string // where each function's flow starts once dropRoots has removed its ROOT node
+	Diff       bool     // blocks are styled as added or removed by diffAgainst
+}
+
+func (d *diagram) addNode(id, label string, s shape, class string) *node {
+	n := &node{ID: id, Label: label, Shape: s, Class: class}
+	d.Nodes = append(d.Nodes, n)
+	return n
+}
+
+func (d *diagram) addEdge(e *edge) {
+	d.Edges = append(d.Edges, e)
+}
+
+func (d *diagram) addSubgraph(id, label string, nodes []string) {
+	d.Subgraphs = append(d.Subgraphs, &subgraph{ID: id, Label: label, Nodes: nodes})
+}
+
+// nodeGroups places each node in the innermost subgraph holding it and
+// returns the nodes left outside every subgraph, plus each subgraph's own
+// nodes. Nodes removed since a subgraph was recorded are skipped.
+func (d *diagram) nodeGroups() ([]*node, map[*subgraph][]*node) {
+	depth := func(sg *subgraph) int {
+		n := 0
+		for p := sg.Parent; p != nil; p = p.Parent {
+			n++
+		}
+		return n
+	}
+	home := make(map[string]*subgraph)
+	for _, sg := range d.Subgraphs {
+		for _, id := range sg.Nodes {
+			if cur, ok := home[id]; !ok || depth(sg) > depth(cur) {
+				home[id] = sg
+			}
+		}
+	}
+
+	var top []*node
+	groups := make(map[*subgraph][]*node)
+	for _, n := range d.Nodes {
+		if sg, ok := home[n.ID]; ok {
+			groups[sg] = append(groups[sg], n)
+		} else {
+			top = append(top, n)
+		}
+	}
+	return top, groups
+}
+
+// childSubgraphs returns the subgraphs directly inside parent, or the
+// outermost ones when parent is nil.
+func (d *diagram) childSubgraphs(parent *subgraph) []*subgraph {
+	var out []*subgraph
+	for _, sg := range d.Subgraphs {
+		if sg.Parent == parent {
+			out = append(out, sg)
+		}
+	}
+	return out
+}
+
+// groupLoops frames each loop in a subgraph. A loop is the header a back
+// edge returns to plus every node that reaches the edge's source without
+// passing through the header; back edges into one header form one loop.
+func (d *diagram) groupLoops() {
+	preds := make(map[string][]string)
+	for _, e := range d.Edges {
+		if !e.Call && !e.Recover && !e.Recurse && e.flow() {
+			preds[e.To] = append(preds[e.To], e.From)
+		}
+	}
+
+	var headers []string
+	bodies := make(map[string]map[string]bool)
+	for _, e := range d.Edges {
+		if !e.Back {
+			continue
+		}
+		body, ok := bodies[e.To]
+		if !ok {
+			body = map[string]bool{e.To: true}
+			bodies[e.To] = body
+			headers = append(headers, e.To)
+		}
+		stack := []string{e.From}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if body[id] {
+				continue
+			}
+			body[id] = true
+			stack = append(stack, preds[id]...)
+		}
+	}
+	if len(headers) == 0 {
+		return
+	}
+	for _, e := range d.Edges {
+		if e.flow() {
+			continue
+		}
+		for _, body := range bodies {
+			if body[e.From] {
+				body[e.To] = true
+			}
+		}
+	}
+
+	for i, h := range headers {
+		var ids []string
+		for _, n := range d.Nodes {
+			if bodies[h][n.ID] {
+				ids = append(ids, n.ID)
+			}
+		}
+		d.addSubgraph(fmt.Sprintf("loop_%d", i+1), "Loop", ids)
+	}
+}
+
+// nestSubgraphs makes each subgraph the child of the smallest other one
+// holding all of its (still present) nodes. Of two with the same nodes,
+// the one recorded first is the outer.
+func (d *diagram) nestSubgraphs() {
+	live := make(map[string]bool)
+	for _, n := range d.Nodes {
+		live[n.ID] = true
+	}
+	sets := make([]map[string]bool, len(d.Subgraphs))
+	for i, sg := range d.Subgraphs {
+		sets[i] = make(map[string]bool)
+		for _, id := range sg.Nodes {
+			if live[id] {
+				sets[i][id] = true
+			}
+		}
+	}
+	contains := func(outer, inner map[string]bool) bool {
+		for id := range inner {
+			if !outer[id] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i, sg := range d.Subgraphs {
+		sg.Parent = nil
+		best := -1
+		for j := range d.Subgraphs {
+			if j == i || !contains(sets[j], sets[i]) {
+				continue
+			}
+			if len(sets[j]) == len(sets[i]) && j > i {
+				continue
+			}
+			if best < 0 || len(sets[j]) < len(sets[best]) || (len(sets[j]) == len(sets[best]) && j > best) {
+				best = j
+			}
+		}
+		if best >= 0 {
+			sg.Parent = d.Subgraphs[best]
+		}
+	}
+}
+
+// edgesByNode groups edges under their source node, preserving insertion order.
+func (d *diagram) edgesByNode() map[string][]*edge {
+	out := make(map[string][]*edge)
+	for _, e := range d.Edges {
+		out[e.From] = append(out[e.From], e)
+	}
+	return out
+}
+
+// flowEdgesByNode is edgesByNode without aside and fork edges, for passes
+// that reason about where the flow goes.
+func (d *diagram) flowEdgesByNode() map[string][]*edge {
+	out := make(map[string][]*edge)
+	for _, e := range d.Edges {
+		if e.flow() {
+			out[e.From] = append(out[e.From], e)
+		}
+	}
+	return out
+}
+
+func (d *diagram) node(id string) *node {
+	for _, n := range d.Nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *diagram) removeNode(id string) {
+	for i, n := range d.Nodes {
+		if n.ID == id {
+			d.Nodes = append(d.Nodes[:i], d.Nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *diagram) removeEdge(e *edge) {
+	for i, x := range d.Edges {
+		if x == e {
+			d.Edges = append(d.Edges[:i], d.Edges[i+1:]...)
+			return
+		}
+	}
+}
+
+// collapseChains merges runs of plain boxes linked by a single forward,
+// unlabeled edge into one node, so straight-line code reads as one step.
+// The next box is only absorbed when that edge is its only way in.
+func (d *diagram) collapseChains() {
+	for {
+		incoming := make(map[string]int)
+		for _, e := range d.Edges {
+			if e.flow() {
+				incoming[e.To]++
+			}
+		}
+		edges := d.flowEdgesByNode()
+
+		merged := false
+		for _, x := range d.Nodes {
+			if x.Shape != shapeBox || len(edges[x.ID]) != 1 {
+				continue
+			}
+			e := edges[x.ID][0]
+			if e.Label != "" || e.Back || incoming[e.To] != 1 {
+				continue
+			}
+			y := d.node(e.To)
+			if y == nil || y == x || y.Shape != shapeBox {
+				continue
+			}
+
+			x.Label += "\n\n" + y.Label
+			if x.Note != "" && y.Note != "" {
+				x.Note += "\n"
+			}
+			x.Note += y.Note
+			if x.Tooltip != "" && y.Tooltip != "" {
+				x.Tooltip += "\n"
+			}
+			x.Tooltip += y.Tooltip
+			if y.Class != "" {
+				x.Class = y.Class
+			}
+		extra:
+			for _, c := range y.ExtraClasses {
+				for _, have := range x.ExtraClasses {
+					if have == c {
+						continue extra
+					}
+				}
+				x.ExtraClasses = append(x.ExtraClasses, c)
+			}
+			d.removeEdge(e)
+			for _, ye := range d.Edges {
+				if ye.From == y.ID {
+					ye.From = x.ID
+				}
+			}
+			d.removeNode(y.ID)
+			merged = true
+			break
+		}
+		if !merged {
+			return
+		}
+	}
+}
+
+// insertBeforeTerminals places a node ahead of every reachable node among
+// nodes with no way out, rerouting the terminal's incoming edges through
+// it. labelFor gives each terminal's label; "" leaves that one alone.
+func (d *diagram) insertBeforeTerminals(nodes []*node, suffix string, labelFor func(*node) string, class string) {
+	incoming := make(map[string][]*edge)
+	for _, e := range d.Edges {
+		if e.flow() {
+			incoming[e.To] = append(incoming[e.To], e)
+		}
+	}
+	edges := d.flowEdgesByNode()
+
+	for _, t := range append([]*node(nil), nodes...) {
+		if len(edges[t.ID]) > 0 || len(incoming[t.ID]) == 0 {
+			continue
+		}
+		label := labelFor(t)
+		if label == "" {
+			continue
+		}
+		id := t.ID + suffix
+		d.addNode(id, label, shapeBox, class)
+		for _, e := range incoming[t.ID] {
+			e.To = id
+		}
+		d.addEdge(&edge{From: id, To: t.ID})
+	}
+}
+
+// mergeTerminals folds nodes among nodes with no way out that look the
+// same, down to label, note, shape and class, into the first of them,
+// which takes over their incoming edges. A node with any edge out, even to
+// a side note, is left alone, as is every id in apart; nodes are only
+// folded together when cut holds all or none of them.
+func (d *diagram) mergeTerminals(nodes []*node, apart, cut map[string]bool) {
+	edges := d.edgesByNode()
+	type look struct {
+		label, note, class string
+		shape              shape
+		cut                bool
+	}
+	first := make(map[look]string)
+	into := make(map[string]string)
+	for _, n := range nodes {
+		if len(edges[n.ID]) > 0 || apart[n.ID] {
+			continue
+		}
+		key := look{n.Label, n.Note, n.Class, n.Shape, cut[n.ID]}
+		if keeper, ok := first[key]; ok {
+			into[n.ID] = keeper
+		} else {
+			first[key] = n.ID
+		}
+	}
+	if len(into) == 0 {
+		return
+	}
+
+	type link struct{ from, to, label string }
+	seen := make(map[link]bool)
+	var kept []*edge
+	for _, e := range d.Edges {
+		keeper, ok := into[e.To]
+		if ok {
+			e.To = keeper
+		}
+		l := link{e.From, e.To, e.Label}
+		if ok && seen[l] {
+			continue
+		}
+		seen[l] = true
+		kept = append(kept, e)
+	}
+	d.Edges = kept
+	for id := range into {
+		d.removeNode(id)
+	}
+}
+
+// dropRoots removes the ROOT node naming each function, and the edge from
+// it, for -no-root. The node the edge led to is recorded in Entries so
+// formats with an explicit start still know where to put it.
+func (d *diagram) dropRoots() {
+	roots := make(map[string]bool)
+	var kept []*node
+	for _, n := range d.Nodes {
+		if n.Class == "root" {
+			roots[n.ID] = true
+		} else {
+			kept = append(kept, n)
+		}
+	}
+	d.Nodes = kept
+	entries := make(map[string]string)
+	var edges []*edge
+	for _, e := range d.Edges {
+		if roots[e.From] {
+			d.Entries = append(d.Entries, e.To)
+			entries[e.From] = e.To
+			continue
+		}
+		edges = append(edges, e)
+	}
+	for _, e := range edges {
+		if to, ok := entries[e.To]; ok {
+			e.To = to
+		}
+	}
+	d.Edges = edges
+}
+
+// splitParts breaks a function drawn as more than size of the given
+// nodes into parts of about size nodes each, framed "Part 1", "Part 2"
+// and so on, so a huge function can be read a page at a time. An edge
+// between parts ends at a "Continues on part N" connector and picks up
+// again from a "Continued from part N" one. Each cut is made where the
+// fewest edges cross, ideally at a block every path runs through, and
+// never through a subgraph already drawn.
+func (d *diagram) splitParts(nodes []*node, size int, prefix string) {
+	if size <= 0 || len(nodes) <= size {
+		return
+	}
+	pos := make(map[string]int)
+	for i, n := range nodes {
+		pos[n.ID] = i
+	}
+	crossing := func(p int) int {
+		count := 0
+		for _, e := range d.Edges {
+			from, ok1 := pos[e.From]
+			to, ok2 := pos[e.To]
+			if ok1 && ok2 && (from < p) != (to < p) {
+				count++
+			}
+		}
+		return count
+	}
+	straddles := func(p int) bool {
+		for _, sg := range d.Subgraphs {
+			before, after := false, false
+			for _, id := range sg.Nodes {
+				if i, ok := pos[id]; ok {
+					before = before || i < p
+					after = after || i >= p
+				}
+			}
+			if before && after {
+				return true
+			}
+		}
+		return false
+	}
+
+	cuts := []int{0}
+	for start := 0; len(nodes)-start > size; {
+		best, fewest := -1, 0
+		for p := start + size; p > start+size/2; p-- {
+			if straddles(p) {
+				continue
+			}
+			if c := crossing(p); best < 0 || c < fewest {
+				best, fewest = p, c
+			}
+		}
+		if best < 0 {
+			break
+		}
+		cuts = append(cuts, best)
+		start = best
+	}
+	if len(cuts) == 1 {
+		return
+	}
+	part := make(map[string]int)
+	for i, n := range nodes {
+		k := 1
+		for k < len(cuts) && i >= cuts[k] {
+			k++
+		}
+		part[n.ID] = k
+	}
+
+	ids := make([][]string, len(cuts)+1)
+	for _, n := range nodes {
+		ids[part[n.ID]] = append(ids[part[n.ID]], n.ID)
+	}
+	connected := make(map[string]bool)
+	for _, e := range d.Edges {
+		from, to := part[e.From], part[e.To]
+		if from == 0 || to == 0 || from == to {
+			continue
+		}
+		out := fmt.Sprintf("OUT%d_%s", from, e.To)
+		in := fmt.Sprintf("IN%d_%s", from, e.To)
+		if !connected[out] {
+			connected[out] = true
+			d.addNode(out, fmt.Sprintf("Continues on part %d", to), shapeStadium, "")
+			d.addNode(in, fmt.Sprintf("Continued from part %d", from), shapeStadium, "")
+			d.addEdge(&edge{From: in, To: e.To})
+			ids[from] = append(ids[from], out)
+			ids[to] = append(ids[to], in)
+		}
+		e.To = out
+		e.Back, e.Long = false, false
+	}
+	for k := 1; k < len(ids); k++ {
+		d.addSubgraph(fmt.Sprintf("%spart%d", prefix, k), fmt.Sprintf("Part %d", k), ids[k])
+	}
+}
+
+// legendClasses are the node classes a legend can explain, in the order
+// it lists them.
+var legendClasses = []struct{ class, text string }{
+	{"root", "Function"},
+	{"successNode", "Successful return"},
+	{"earlyReturn", "Early return"},
+	{"errorNode", "Error return or panic"},
+	{"endNode", "End"},
+	{"mergeNode", "Paths merge"},
+	{"deferNode", "Deferred calls"},
+	{"goroutineNode", "Goroutine"},
+	{"externalNode", "Function outside the loaded code"},
+	{"noiseNode", "Filtered logging and metrics"},
+	{"unreachableNode", "Unreachable code"},
+	{"highlight", "Matches -highlight"},
+}
+
+// addLegend adds a key, framed on its own and unconnected to the flow,
+// explaining the shapes, colors and edge styles the diagram actually
+// uses, so it follows the theme and whichever options produced them.
+func (d *diagram) addLegend() {
+	classes := make(map[string]bool)
+	shapes := make(map[shape]bool)
+	for _, n := range d.Nodes {
+		classes[n.Class] = true
+		for _, c := range n.ExtraClasses {
+			classes[c] = true
+		}
+		shapes[n.Shape] = true
+	}
+	edges := make(map[string]bool)
+	for _, e := range d.Edges {
+		edges["back"] = edges["back"] || e.Back
+		edges["call"] = edges["call"] || e.Call
+		edges["panic"] = edges["panic"] || e.Panic
+		edges["recover"] = edges["recover"] || e.Recover
+		edges["fork"] = edges["fork"] || e.Fork
+		edges["recurse"] = edges["recurse"] || e.Recurse
+	}
+
+	var ids []string
+	add := func(label string, s shape, class string) string {
+		id := fmt.Sprintf("KEY%d", len(ids)+1)
+		d.addNode(id, label, s, class)
+		ids = append(ids, id)
+		return id
+	}
+	if shapes[shapeDiamond] {
+		add("Decision", shapeDiamond, "")
+	}
+	if shapes[shapeSubroutine] {
+		add("Call", shapeSubroutine, "")
+	}
+	if shapes[shapeParallelogram] {
+		add("Channel operation", shapeParallelogram, "")
+	}
+	for _, c := range legendClasses {
+		if classes[c.class] {
+			add(c.text, shapeBox, c.class)
+		}
+	}
+	samples := []struct {
+		kind, text string
+		e          edge
+	}{
+		{"back", "Loop back", edge{Back: true}},
+		{"call", "Call into an expanded function", edge{Call: true}},
+		{"panic", "Panic", edge{Panic: true}},
+		{"recover", "Recovery from a panic", edge{Recover: true}},
+		{"fork", "Goroutine started", edge{Fork: true}},
+		{"recurse", "Recursive call", edge{Recurse: true}},
+	}
+	for _, s := range samples {
+		if !edges[s.kind] {
+			continue
+		}
+		e := s.e
+		e.From = add(s.text, shapeBox, "")
+		e.To = add(" ", shapeCircle, "")
+		d.addEdge(&e)
+	}
+	if len(ids) > 0 {
+		d.addSubgraph("key", "Legend", ids)
+	}
+}
+
+// sortTopological reorders node declarations so each node follows every
+// node with a forward edge into it. Back and recover edges are ignored;
+// ties, and anything left over from a cycle, keep their original order.
+func (d *diagram) sortTopological() {
+	pos := make(map[string]int)
+	for i, n := range d.Nodes {
+		pos[n.ID] = i
+	}
+	indegree := make(map[string]int)
+	out := make(map[string][]string)
+	for _, e := range d.Edges {
+		if e.Back || e.Recover || e.Recurse {
+			continue
+		}
+		if _, ok := pos[e.From]; !ok {
+			continue
+		}
+		if _, ok := pos[e.To]; !ok {
+			continue
+		}
+		indegree[e.To]++
+		out[e.From] = append(out[e.From], e.To)
+	}
+
+	placed := make(map[string]bool)
+	sorted := make([]*node, 0, len(d.Nodes))
+	for len(sorted) < len(d.Nodes) {
+		// Take the earliest ready node, or failing that break a cycle at
+		// the earliest node not yet placed.
+		next := -1
+		for i, n := range d.Nodes {
+			if !placed[n.ID] && indegree[n.ID] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			for i, n := range d.Nodes {
+				if !placed[n.ID] {
+					next = i
+					break
+				}
+			}
+		}
+		n := d.Nodes[next]
+		placed[n.ID] = true
+		sorted = append(sorted, n)
+		for _, to := range out[n.ID] {
+			indegree[to]--
+		}
+	}
+	d.Nodes = sorted
+}
+
+// cutNodes removes the nodes in cut. Edges between a kept node and a cut
+// one are redrawn to or from a "..." node standing in for that cut node,
+// so the diagram shows each place the flow leaves and where it rejoins,
+// and stays connected.
+func (d *diagram) cutNodes(cut map[string]bool) {
+	var standIns []string
+	added := make(map[string]bool)
+	standIn := func(id string) string {
+		id += "_cut"
+		if !added[id] {
+			added[id] = true
+			standIns = append(standIns, id)
+		}
+		return id
+	}
+	type key struct{ from, to, label string }
+	seen := make(map[key]bool)
+	var edges []*edge
+	for _, e := range d.Edges {
+		if cut[e.From] && cut[e.To] {
+			continue
+		}
+		if cut[e.From] {
+			e.From = standIn(e.From)
+		} else if cut[e.To] {
+			e.To = standIn(e.To)
+		}
+		if k := (key{e.From, e.To, e.Label}); !seen[k] {
+			seen[k] = true
+			edges = append(edges, e)
+		}
+	}
+	d.Edges = edges
+
+	var nodes []*node
+	for _, n := range d.Nodes {
+		if !cut[n.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	for _, id := range standIns {
+		nodes = append(nodes, &node{ID: id, Label: "...", Shape: shapeCircle})
+	}
+	d.Nodes = nodes
+}
+
+// stableIDs renames every node after a hash of its text rather than the
+// cfg block index it came from, so a node keeps its ID when unrelated code
+// is added and two generated diagrams diff cleanly. Nodes with the same
+// text are numbered in the order they appear.
+func (d *diagram) stableIDs() {
+	rename := make(map[string]string)
+	seen := make(map[string]int)
+	for _, n := range d.Nodes {
+		sum := sha1.Sum([]byte(n.Label + "\x00" + n.Note))
+		id := fmt.Sprintf("N%x", sum[:4])
+		if seen[id]++; seen[id] > 1 {
+			id = fmt.Sprintf("%s_%d", id, seen[id])
+		}
+		rename[n.ID] = id
+		n.ID = id
+	}
+	for _, e := range d.Edges {
+		e.From, e.To = rename[e.From], rename[e.To]
+	}
+	for _, sg := range d.Subgraphs {
+		for i, id := range sg.Nodes {
+			if to, ok := rename[id]; ok {
+				sg.Nodes[i] = to
+			}
+		}
+	}
+}
+
+// highlight marks every node whose label, read as one line, contains
+// pattern or matches it as a regular expression.
+func (d *diagram) highlight(pattern string) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = nil
+	}
+	for _, n := range d.Nodes {
+		text := strings.ReplaceAll(n.Label, "\n", " ")
+		if strings.Contains(text, pattern) || (re != nil && re.MatchString(text)) {
+			n.ExtraClasses = append(n.ExtraClasses, "highlight")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package flowgen
+
+import (
+	"golang.org/x/tools/go/packages"
+)
+
+// ==========================================
+// FLOW DIFF
+// ==========================================
+
+// diffBase draws roots again as they are declared in pkgs, the tree
+// -diff compares against. Functions it doesn't declare are left out; with
+// none left there is nothing to compare and the result is nil.
+func diffBase(pkgs []*packages.Package, roots []target, opts Options, index funcIndex) (*diagram, error) {
+	var base []target
+	for _, t := range roots {
+		if old, err := findStartingFunction(pkgs, t.Name); err == nil {
+			base = append(base, old)
+		}
+	}
+	if len(base) == 0 {
+		return nil, nil
+	}
+	return analyzeCFG(base, opts, index, nil)
+}
+
+// diffAgainst overlays old, the same functions drawn from the -diff tree,
+// onto d. Both carry stable IDs, so a block whose text didn't change has
+// the same ID in each: blocks only d has are styled as added, blocks only
+// old has are drawn back in as removed, and the rest are left plain. The
+// edges are those of both.
+func (d *diagram) diffAgainst(old *diagram) {
+	d.Diff = true
+	had := make(map[string]bool)
+	if old != nil {
+		for _, n := range old.Nodes {
+			had[n.ID] = true
+		}
+	}
+	has := make(map[string]bool)
+	for _, n := range d.Nodes {
+		has[n.ID] = true
+		switch {
+		case !had[n.ID]:
+			n.Class, n.ExtraClasses = "addedNode", nil
+		case n.Class != "root":
+			n.Class, n.ExtraClasses = "", nil
+		}
+	}
+	if old == nil {
+		return
+	}
+
+	for _, n := range old.Nodes {
+		if !has[n.ID] {
+			n.Class, n.ExtraClasses = "removedNode", nil
+			d.Nodes = append(d.Nodes, n)
+		}
+	}
+	type key struct{ from, to, label string }
+	seen := make(map[key]bool)
+	for _, e := range d.Edges {
+		seen[key{e.From, e.To, e.Label}] = true
+	}
+	for _, e := range old.Edges {
+		if k := (key{e.From, e.To, e.Label}); !seen[k] {
+			seen[k] = true
+			d.Edges = append(d.Edges, e)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package flowgen
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// ==========================================
+// GRAPHVIZ DOT RENDERER
+// ==========================================
+
+func renderDOT(w *bufio.Writer, d *diagram) {
+	w.WriteString("digraph flow {\n")
+	for _, c := range d.Comments {
+		fmt.Fprintf(w, "    // %s\n", c)
+	}
+	fmt.Fprintf(w, "    rankdir=%s;\n", dotRankDir(d.Direction))
+	th := d.theme()
+	if th.Background != "" {
+		fmt.Fprintf(w, "    bgcolor=%s;\n    fontcolor=%s;\n", dotQuote(th.Background), dotQuote(th.NodeText))
+	}
+	fmt.Fprintf(w, "    node [shape=box, style=\"rounded,filled\", fillcolor=%s, fontcolor=%s, color=%s, fontname=\"Helvetica\"];\n", dotQuote(th.NodeFill), dotQuote(th.NodeText), dotQuote(th.Line))
+	fmt.Fprintf(w, "    edge [color=%s, fontcolor=%s, fontname=\"Helvetica\"];\n\n", dotQuote(th.Line), dotQuote(th.NodeText))
+
+	edges := d.edgesByNode()
+	if len(d.Subgraphs) == 0 {
+		for _, n := range d.Nodes {
+			fmt.Fprintf(w, "    %s [%s];\n", n.ID, dotNodeAttrs(n, th))
+			for _, e := range edges[n.ID] {
+				fmt.Fprintf(w, "    %s -> %s%s;\n", e.From, e.To, dotEdgeAttrs(e, th))
+			}
+		}
+	} else {
+		top, groups := d.nodeGroups()
+		for _, n := range top {
+			fmt.Fprintf(w, "    %s [%s];\n", n.ID, dotNodeAttrs(n, th))
+		}
+		var writeCluster func(sg *subgraph, indent string)
+		writeCluster = func(sg *subgraph, indent string) {
+			fmt.Fprintf(w, "\n%ssubgraph cluster_%s {\n", indent, sg.ID)
+			fmt.Fprintf(w, "%s    label=%s;\n%s    style=rounded;\n", indent, dotQuote(sg.Label), indent)
+			for _, n := range groups[sg] {
+				fmt.Fprintf(w, "%s    %s [%s];\n", indent, n.ID, dotNodeAttrs(n, th))
+			}
+			for _, child := range d.childSubgraphs(sg) {
+				writeCluster(child, indent+"    ")
+			}
+			w.WriteString(indent + "}\n")
+		}
+		for _, sg := range d.childSubgraphs(nil) {
+			writeCluster(sg, "    ")
+		}
+		w.WriteString("\n")
+		for _, n := range d.Nodes {
+			for _, e := range edges[n.ID] {
+				fmt.Fprintf(w, "    %s -> %s%s;\n", e.From, e.To, dotEdgeAttrs(e, th))
+			}
+		}
+	}
+	w.WriteString("}\n")
+}
+
+// dotRankDir maps a Mermaid direction onto Graphviz's rankdir, which spells top-down as TB.
+func dotRankDir(direction string) string {
+	if direction == "TD" || direction == "" {
+		return "TB"
+	}
+	return direction
+}
+
+func dotNodeAttrs(n *node, th *theme) string {
+	attrs := []string{fmt.Sprintf("label=%s", dotQuote(n.Label))}
+	if n.Note != "" {
+		attrs[0] = fmt.Sprintf("label=<%s<BR/><I>%s</I>>", dotHTML(n.Label), dotHTML(n.Note))
+	}
+	if n.Tooltip != "" {
+		attrs = append(attrs, fmt.Sprintf("tooltip=%s", dotQuote(n.Tooltip)))
+	}
+
+	switch n.Shape {
+	case shapeDiamond:
+		attrs = append(attrs, "shape=diamond", "style=filled")
+	case shapeCircle:
+		attrs = append(attrs, "shape=circle")
+	case shapeSubroutine:
+		attrs = append(attrs, "peripheries=2")
+	case shapeParallelogram:
+		attrs = append(attrs, "shape=parallelogram", "style=filled")
+	}
+
+	// Later classes win, so extra classes such as highlight override the base style.
+	var fill, color string
+	dashed := false
+	for _, name := range append([]string{n.Class}, n.ExtraClasses...) {
+		if c, ok := th.class(name); ok {
+			fill, color = c.Fill, c.Color
+			dashed = dashed || c.Dashed
+		}
+	}
+	if fill != "" {
+		attrs = append(attrs, fmt.Sprintf("fillcolor=%s", dotQuote(fill)), fmt.Sprintf("fontcolor=%s", dotQuote(color)))
+	}
+	if dashed {
+		style := "rounded,filled" // the graph's node default
+		for i, a := range attrs {
+			if strings.HasPrefix(a, "style=") {
+				style = strings.TrimPrefix(a, "style=")
+				attrs = append(attrs[:i], attrs[i+1:]...)
+				break
+			}
+		}
+		attrs = append(attrs, fmt.Sprintf("style=\"%s,dashed\"", style))
+	}
+	return strings.Join(attrs, ", ")
+}
+
+func dotEdgeAttrs(e *edge, th *theme) string {
+	var attrs []string
+	if e.Label != "" {
+		attrs = append(attrs, fmt.Sprintf("label=%s", dotQuote(e.Label)))
+	}
+	if e.Aside {
+		attrs = append(attrs, "style=dotted", "arrowhead=none")
+	} else if e.Fork {
+		attrs = append(attrs, "style=dashed")
+	} else if e.Call {
+		attrs = append(attrs, "style=bold")
+	} else if e.Back || e.Recover || e.Recurse {
+		attrs = append(attrs, "style=dashed")
+	} else if e.Long {
+		attrs = append(attrs, "minlen=2")
+	}
+	if e.Panic {
+		c, _ := th.class("errorNode")
+		attrs = append(attrs, fmt.Sprintf("color=%s", dotQuote(c.Fill)))
+	}
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+// dotHTML escapes s for an HTML-like label, which DOT needs for italics.
+func dotHTML(s string) string {
+	s = html.EscapeString(s)
+	return strings.ReplaceAll(s, "\n", "<BR/>")
+}
+
+// dotQuote returns s as a DOT double-quoted string, turning label line
+// breaks into DOT's centered-line escape.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	return "\"" + s + "\""
+}
@@ -0,0 +1,233 @@
+package flowgen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// ==========================================
+// INTERPROCEDURAL EXPANSION
+// ==========================================
+
+// funcIndex maps every function and method declared in the loaded
+// packages to its declaration, so calls can be followed into callees.
+type funcIndex map[*types.Func]target
+
+// callSite is a call from a diagram node into a function in the index,
+// or with External into a package loaded without syntax.
+type callSite struct {
+	From     string
+	Callee   *types.Func
+	External bool
+}
+
+func buildFuncIndex(pkgs []*packages.Package) funcIndex {
+	index := make(funcIndex)
+	for _, t := range allFunctions(pkgs) {
+		if t.Pkg.TypesInfo == nil {
+			continue
+		}
+		if fn, ok := t.Pkg.TypesInfo.Defs[t.Decl.Name].(*types.Func); ok {
+			index[fn] = t
+		}
+	}
+	return index
+}
+
+// lookup returns the indexed function declared by t, if any.
+func (index funcIndex) lookup(t target) *types.Func {
+	for fn, x := range index {
+		if x.Decl == t.Decl {
+			return fn
+		}
+	}
+	return nil
+}
+
+// packages returns the packages the indexed functions are declared in.
+func (index funcIndex) packages() map[*types.Package]bool {
+	pkgs := make(map[*types.Package]bool)
+	for fn := range index {
+		pkgs[fn.Pkg()] = true
+	}
+	return pkgs
+}
+
+// callSites lists the functions called directly by nodes, leaving out
+// calls made inside function literals: indexed ones, and ones from
+// packages whose source wasn't loaded, which can't be expanded.
+func (fb *flowBuilder) callSites(from string, nodes []ast.Node, info *types.Info) []callSite {
+	if fb.index == nil || info == nil {
+		return nil
+	}
+	var calls []callSite
+	seen := make(map[*types.Func]bool)
+	for _, n := range nodes {
+		ast.Inspect(n, func(x ast.Node) bool {
+			switch x := x.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				fn := calleeOf(x, info)
+				if fn == nil || seen[fn] {
+					break
+				}
+				if _, ok := fb.index[fn]; ok {
+					seen[fn] = true
+					calls = append(calls, callSite{From: from, Callee: fn})
+				} else if fb.isExternal(fn) {
+					seen[fn] = true
+					calls = append(calls, callSite{From: from, Callee: fn, External: true})
+				}
+			}
+			return true
+		})
+	}
+	return calls
+}
+
+// recursion links the node id to its function's ROOT with a dashed
+// "recurse" edge when nodes call self, the function being drawn. It only
+// applies without expansion: with it, a recursive call already links to
+// the copy of the function drawn for the first call.
+func (fb *flowBuilder) recursion(id, prefix string, nodes []ast.Node, self *types.Func, info *types.Info) {
+	if fb.index != nil || self == nil {
+		return
+	}
+	found := false
+	for _, n := range nodes {
+		ast.Inspect(n, func(x ast.Node) bool {
+			switch x := x.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				found = found || calleeOf(x, info) == self
+			}
+			return !found
+		})
+	}
+	if found {
+		fb.d.addEdge(&edge{From: id, To: prefix + "ROOT", Label: "recurse", Recurse: true})
+	}
+}
+
+// calleeOf resolves the statically known function a call invokes. Calls
+// through interfaces or function values resolve to nothing.
+func calleeOf(call *ast.CallExpr, info *types.Info) *types.Func {
+	fun := ast.Unparen(call.Fun)
+	switch x := fun.(type) {
+	case *ast.IndexExpr:
+		fun = x.X
+	case *ast.IndexListExpr:
+		fun = x.X
+	}
+
+	var id *ast.Ident
+	switch x := fun.(type) {
+	case *ast.Ident:
+		id = x
+	case *ast.SelectorExpr:
+		id = x.Sel
+	default:
+		return nil
+	}
+	fn, ok := info.Uses[id].(*types.Func)
+	if !ok {
+		return nil
+	}
+	return fn.Origin()
+}
+
+// isExternal reports whether fn is declared in a package loaded without
+// syntax, such as the standard library. Interface methods don't count:
+// the call isn't bound to any one package's code.
+func (fb *flowBuilder) isExternal(fn *types.Func) bool {
+	if fn.Pkg() == nil || fb.local[fn.Pkg()] {
+		return false
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	return recv == nil || !types.IsInterface(recv.Type())
+}
+
+// externalName names a function outside the loaded packages by its
+// package name, e.g. "os.ReadFile" or "(*bytes.Buffer).Write", with the
+// names r hides replaced.
+func externalName(fn *types.Func, r *redactor) string {
+	qualifier := func(p *types.Package) string { return r.pkg(p.Path(), p.Name()) }
+	if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+		t, star := recv.Type(), ""
+		if ptr, ok := t.(*types.Pointer); ok {
+			t, star = ptr.Elem(), "*"
+		}
+		typ := types.TypeString(t, qualifier)
+		if named, ok := t.(*types.Named); ok && r != nil {
+			typ = qualifier(named.Obj().Pkg()) + "." + r.object(named.Obj())
+		}
+		return fmt.Sprintf("(%s%s).%s", star, typ, r.object(fn))
+	}
+	return qualifier(fn.Pkg()) + "." + r.object(fn)
+}
+
+// expandCalls adds each callee's flow as a subgraph linked from its call
+// site. A callee is drawn once per diagram; later calls to it, including
+// recursive ones, link to the existing copy. External callees get a
+// single opaque node marking where expansion stops.
+func (fb *flowBuilder) expandCalls(calls []callSite, depth int) {
+	if depth > fb.opts.Depth {
+		return
+	}
+	for _, c := range calls {
+		fb.expandCall(c, depth)
+	}
+}
+
+// expandEntry expands a root's calls. With -entry-expand, the ones into
+// the root's own package are expanded even when -depth wouldn't reach
+// them, giving an overview of what an entry point orchestrates; -depth
+// still decides how far past them expansion goes.
+func (fb *flowBuilder) expandEntry(pkg *types.Package, calls []callSite) {
+	if !fb.opts.EntryExpand {
+		fb.expandCalls(calls, 1)
+		return
+	}
+	for _, c := range calls {
+		if fb.opts.Depth > 0 || (!c.External && c.Callee.Pkg() == pkg) {
+			fb.expandCall(c, 1)
+		}
+	}
+}
+
+func (fb *flowBuilder) expandCall(c callSite, depth int) {
+	if c.External {
+		id, ok := fb.external[c.Callee]
+		if !ok {
+			id = fmt.Sprintf("X%d", len(fb.external)+1)
+			fb.d.addNode(id, externalName(c.Callee, fb.redact), shapeSubroutine, "externalNode")
+			fb.external[c.Callee] = id
+		}
+		fb.d.addEdge(&edge{From: c.From, To: id, Label: "calls", Call: true})
+		return
+	}
+	entry, ok := fb.expanded[c.Callee]
+	if !ok {
+		callee := fb.index[c.Callee]
+		fb.next++
+		prefix := fmt.Sprintf("F%d_", fb.next)
+
+		first := len(fb.d.Nodes)
+		var sub []callSite
+		entry, sub, _ = fb.addFunction(callee, prefix)
+		fb.expanded[c.Callee] = entry
+
+		var ids []string
+		for _, n := range fb.d.Nodes[first:] {
+			ids = append(ids, n.ID)
+		}
+		fb.d.addSubgraph(prefix+"fn", fb.title(callee), ids)
+		fb.expandCalls(sub, depth+1)
+	}
+	fb.d.addEdge(&edge{From: c.From, To: entry, Label: "calls", Call: true})
+}
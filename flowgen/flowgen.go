@@ -0,0 +1,3586 @@
+package flowgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/cfg"
+	"golang.org/x/tools/go/packages"
+)
+
+// DefaultExclude is the noise list the command line uses unless -exclude
+// replaces it: instrumentation whose calls clutter a flowchart.
+const DefaultExclude = "metrics,span,tracing,log,logger"
+
+// Options selects the code to analyze and how to draw it. The zero value
+// of each setting picks its default, except Exclude, which is empty (no
+// filtering) rather than DefaultExclude.
+type Options struct {
+	Dir             string        // package directory, or a single Go file; defaults to "."
+	Source          io.Reader     // if set, a single Go file is read from it instead of loading Dir
+	Start           string        // function to analyze, as accepted by -start; defaults to "main"
+	CallGraph       bool          // draw each package's functions and the calls between them instead of any one function's flow
+	All             bool          // analyze every function instead of Start
+	Match           string        // analyze every function whose name matches this pattern instead of Start
+	Exclude         string        // comma-separated packages/variables whose calls are dropped
+	Ignore          string        // more names to drop, on top of Exclude
+	IgnoreRegex     string        // drop calls whose base identifier matches this pattern
+	Format          string        // "mermaid" (default), "state", "dot", "plantuml" or "svg"
+	Direction       string        // TD (default), LR, BT or RL
+	NoRoot          bool          // leave out the ROOT node naming the function, starting at its first block
+	Legend          bool          // add a detached key explaining the shapes, colors and edge styles used
+	ResolveConsts   bool          // follow named constants in comparisons with their values, e.g. StatusActive (2)
+	SyncHints       bool          // phrase mutex and wait group calls as acquiring, releasing and waiting
+	Nest            bool          // frame blocks by the if, for, switch or select statement they belong to, instead of framing loops
+	Pos             string        // file.go:line:col; draw the function enclosing it instead of Start
+	Diff            string        // directory holding an earlier version of the code to mark added and removed blocks against
+	SplitAt         int           // split functions drawn as more than this many blocks into linked parts (0 for never)
+	Collapse        bool          // merge chains of straight-line blocks
+	Sort            string        // node declaration order: "blocks" (default, CFG order) or "topo"
+	StableIDs       bool          // name nodes after a hash of their text instead of cfg block indices
+	Defers          string        // "inline" (default), "end" or "hide"
+	Highlight       string        // mark blocks whose label contains or matches this
+	ColorByPackage  bool          // color each block by the other package it calls into most, with a legend
+	TrueLabel       string        // label for the edge taken when a condition holds; "True" by default
+	FalseLabel      string        // label for the edge taken when it doesn't; "False" by default
+	LoopLabel       string        // label for the edge into another loop iteration; "Next" by default
+	FromLine        int           // draw only the blocks with a statement on or after this line; 0 for no limit
+	ToLine          int           // draw only the blocks with a statement on or before this line; 0 for no limit
+	Depth           int           // expand calls into loaded functions this many levels deep
+	EntryExpand     bool          // always expand the start function's calls into its own package, one level, whatever Depth is
+	MaxLabel        int           // truncate statement labels to this many characters; 0 for no limit
+	Shorten         int           // keep only this many trailing names of selector chains in labels; 0 keeps them whole
+	Lines           bool          // prefix statement labels with their source line range
+	Comments        bool          // show the author's comments on statements under their labels
+	Tooltips        bool          // attach each block's full source as a hover tooltip
+	Compact         bool          // label each block with one line, its last statement, moving the rest to a tooltip
+	Shapes          bool          // draw call blocks as subroutines and channel operations as parallelograms
+	IdiomaticErrors bool          // phrase err != nil checks as "Check err" with on error/success edges
+	ShowNoise       bool          // keep filtered calls visible as muted side notes
+	NoFilter        bool          // skip noise filtering entirely; there is then nothing for ShowNoise to show
+	PruneReturns    bool          // route every return to one shared End node
+	MergeReturns    bool          // draw identical ways out, such as several "return nil", as one node
+	Complexity      bool          // note the cyclomatic complexity as a comment in the output
+	WithSource      bool          // follow the diagram with the function's source in a go code block
+	Validate        bool          // check every Mermaid label is escaped, failing on the first that isn't
+	Redact          bool          // replace the code's identifiers with generic names such as var1 and func1
+	Keep            string        // comma-separated identifiers Redact leaves alone; "std" keeps the standard library's
+	Theme           string        // "light" (default), "dark" or "neutral"
+	RootColor       string        // fill for the function's root node, overriding the theme
+	EndColor        string        // fill for successful exits, overriding the theme
+	Tags            string        // comma-separated build tags to load packages with
+	GOOS            string        // target operating system, if not the host's
+	GOARCH          string        // target architecture, if not the host's
+	Tests           bool          // also load _test.go files so test functions and helpers can be drawn
+	Overlay         string        // go build -overlay JSON file replacing or adding source files, e.g. generated ones
+	Timeout         time.Duration // give up loading packages after this long; 0 waits indefinitely
+	Progress        io.Writer     // if set, receives progress messages and notes, e.g. when loading starts
+	Debug           io.Writer     // if set, receives a dump of each function's cfg blocks before drawing
+}
+
+// target is a function selected for analysis.
+type target struct {
+	Name string // display name, e.g. "Run" or "Server.Handle"
+	Decl *ast.FuncDecl
+	Pkg  *packages.Package
+}
+
+// Result is the rendered diagram for one function. With Redact, its
+// names are the stand-ins the diagram uses.
+type Result struct {
+	Name       string         // display name, e.g. "Run" or "Server.Handle"
+	Receiver   string         // receiver type for methods, e.g. "Server"; "" for functions
+	Package    string         // import path of the function's package, or its name when there is none
+	Pos        token.Position // where the function is declared
+	Complexity int            // cyclomatic complexity of the function's control flow
+	Output     string
+}
+
+// Generate renders the requested function, or with All or Match every
+// selected function as one document, and returns the text. -start init
+// with several init functions also gives one document, a diagram each.
+func Generate(opts Options) (string, error) {
+	var buf strings.Builder
+	if err := WriteTo(&buf, opts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// WriteTo renders what Generate does straight to w, such as an HTTP
+// response or a buffer, for callers embedding flowgen rather than
+// writing files. Each diagram is written as soon as it is drawn, so a
+// document of many functions is never held in memory whole.
+func WriteTo(w io.Writer, opts Options) error {
+	return generate(opts, func(r Result, i, count int, write func(io.Writer) error) error {
+		if count == 1 && !opts.All && opts.Match == "" {
+			return write(w)
+		}
+		if opts.Format == "svg" {
+			return fmt.Errorf("-format svg writes one file per function; it can't combine %d functions into one document", count)
+		}
+		if _, err := io.WriteString(w, combinedHeading(r, i, opts.Format)); err != nil {
+			return err
+		}
+		return write(w)
+	})
+}
+
+// GenerateEach analyzes the requested function(s) and renders each in the
+// requested format.
+func GenerateEach(opts Options) ([]Result, error) {
+	var results []Result
+	err := generate(opts, func(r Result, i, count int, write func(io.Writer) error) error {
+		var buf strings.Builder
+		if err := write(&buf); err != nil {
+			return err
+		}
+		r.Output = buf.String()
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// emitFunc receives each diagram generate draws: its Result, without
+// Output, and write, which renders it to a writer. i counts the diagrams
+// emitted before it and count is how many there are to draw.
+type emitFunc func(r Result, i, count int, write func(io.Writer) error) error
+
+// generate analyzes the requested function(s) and hands each diagram to
+// emit as it is drawn.
+func generate(opts Options, emit emitFunc) error {
+	if opts.Dir == "" {
+		opts.Dir = "."
+	}
+	if opts.Start == "" {
+		opts.Start = "main"
+	}
+	if opts.Format == "" {
+		opts.Format = "mermaid"
+	}
+	if opts.Direction == "" {
+		opts.Direction = "TD"
+	}
+	if opts.Defers == "" {
+		opts.Defers = "inline"
+	}
+	if opts.TrueLabel == "" {
+		opts.TrueLabel = "True"
+	}
+	if opts.FalseLabel == "" {
+		opts.FalseLabel = "False"
+	}
+	if opts.LoopLabel == "" {
+		opts.LoopLabel = "Next"
+	}
+
+	switch opts.Format {
+	case "mermaid", "state", "dot", "plantuml":
+	case "svg":
+		if _, err := exec.LookPath("mmdc"); err != nil {
+			return fmt.Errorf("-format svg needs the Mermaid CLI (mmdc) on PATH; install it with 'npm install -g @mermaid-js/mermaid-cli'")
+		}
+	default:
+		return fmt.Errorf("unknown format '%s' (expected 'mermaid', 'state', 'dot', 'plantuml' or 'svg')", opts.Format)
+	}
+	if opts.Validate && opts.Format != "mermaid" && opts.Format != "state" && opts.Format != "svg" {
+		return fmt.Errorf("-validate checks Mermaid output; use it with -format mermaid, state or svg")
+	}
+	if opts.WithSource && opts.Format != "mermaid" && opts.Format != "state" {
+		return fmt.Errorf("-with-source adds a Markdown code block; use it with -format mermaid or state")
+	}
+	if opts.ToLine > 0 && opts.FromLine > opts.ToLine {
+		return fmt.Errorf("-from-line %d is after -to-line %d", opts.FromLine, opts.ToLine)
+	}
+	switch opts.Direction {
+	case "TD", "LR", "BT", "RL":
+	default:
+		return fmt.Errorf("unknown direction '%s' (expected TD, LR, BT or RL)", opts.Direction)
+	}
+	switch opts.Sort {
+	case "", "blocks", "topo":
+	default:
+		return fmt.Errorf("unknown -sort order '%s' (expected blocks or topo)", opts.Sort)
+	}
+	switch opts.Defers {
+	case "inline", "end", "hide":
+	default:
+		return fmt.Errorf("unknown -defers mode '%s' (expected inline, end or hide)", opts.Defers)
+	}
+
+	if opts.Legend && (opts.Format == "plantuml" || opts.Format == "state") {
+		return fmt.Errorf("-legend draws a detached key, which only flowcharts can hold; use -format mermaid, dot or svg")
+	}
+	if opts.SplitAt > 0 && opts.Format == "plantuml" {
+		return fmt.Errorf("-split-at draws parts joined by off-page connectors, which PlantUML's structured activities can't hold; use -format mermaid, state, dot or svg")
+	}
+	if opts.Pos != "" && (opts.All || opts.Match != "" || opts.CallGraph) {
+		return fmt.Errorf("-pos picks the one function at a position; it can't be combined with -all, -match or -callgraph")
+	}
+	if opts.Diff != "" && (opts.CallGraph || opts.Source != nil) {
+		return fmt.Errorf("-diff compares functions' flow between two directories; it can't be used with -callgraph or -stdin")
+	}
+	if opts.Diff != "" && opts.Format == "plantuml" {
+		return fmt.Errorf("-diff draws removed blocks beside the flow, which PlantUML's structured activities can't hold; use -format mermaid, state, dot or svg")
+	}
+	if opts.Redact && (opts.Comments || opts.WithSource) {
+		return fmt.Errorf("-redact hides names in the flow, not in free text or source; it can't be combined with -comments or -with-source")
+	}
+	if opts.Redact && opts.Diff != "" {
+		return fmt.Errorf("-redact numbers names in the order it meets them, so two versions can't be matched; it can't be combined with -diff")
+	}
+	if opts.CallGraph && opts.Format == "plantuml" {
+		return fmt.Errorf("-callgraph draws a free-form graph, which a PlantUML activity diagram can't hold; use -format mermaid, state, dot or svg")
+	}
+
+	th, err := newTheme(opts)
+	if err != nil {
+		return err
+	}
+
+	pkgs, err := loadPackages(opts)
+	if err != nil {
+		return err
+	}
+	// One redactor serves every diagram, so a name has the same stand-in
+	// in each and in the headings and file names naming them.
+	var redact *redactor
+	if opts.Redact {
+		redact = newRedactor(opts.Keep)
+	}
+	if opts.CallGraph {
+		return callGraphs(pkgs, opts, th, redact, emit)
+	}
+
+	var targets []target
+	if opts.All {
+		targets = allFunctions(pkgs)
+		if len(targets) == 0 {
+			return fmt.Errorf("no functions with bodies found in %s", opts.Dir)
+		}
+	} else if opts.Match != "" {
+		re, err := regexp.Compile(opts.Match)
+		if err != nil {
+			return fmt.Errorf("invalid -match: %v", err)
+		}
+		for _, t := range allFunctions(pkgs) {
+			if re.MatchString(t.Decl.Name.Name) || re.MatchString(t.Name) {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("no functions match '%s'", opts.Match)
+		}
+	}
+
+	// Each group is drawn as one diagram. Several -start functions share
+	// one, so the callees they have in common are drawn once. A package
+	// may declare any number of init functions, so -start init draws each
+	// of them in a diagram of its own.
+	var groups [][]target
+	for _, t := range targets {
+		groups = append(groups, []target{t})
+	}
+	if opts.Pos != "" {
+		t, err := findByPosition(pkgs, opts.Pos, opts.Dir)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, []target{t})
+	} else if !opts.All && opts.Match == "" {
+		var roots []target
+		for _, name := range strings.Split(opts.Start, ",") {
+			name = strings.TrimSpace(name)
+			if inits := findInits(pkgs, name); len(inits) > 1 {
+				for _, t := range inits {
+					groups = append(groups, []target{t})
+				}
+				continue
+			}
+			t, err := findStartingFunction(pkgs, name)
+			if err != nil {
+				return err
+			}
+			roots = append(roots, t)
+		}
+		if len(roots) > 0 {
+			groups = append([][]target{roots}, groups...)
+		}
+	}
+
+	var index funcIndex
+	if opts.Depth > 0 || opts.EntryExpand {
+		index = buildFuncIndex(pkgs)
+	}
+
+	// With -diff, blocks are matched between the two trees by their
+	// stable IDs.
+	var basePkgs []*packages.Package
+	var baseIndex funcIndex
+	if opts.Diff != "" {
+		opts.StableIDs = true
+		baseOpts := opts
+		baseOpts.Dir = opts.Diff
+		basePkgs, err = loadPackages(baseOpts)
+		if err != nil {
+			return err
+		}
+		if index != nil {
+			baseIndex = buildFuncIndex(basePkgs)
+		}
+	}
+
+	emitted := 0
+	var skipped []string
+	for _, roots := range groups {
+		var names []string
+		for _, t := range roots {
+			name, _ := redact.name(t)
+			names = append(names, name)
+		}
+		name := strings.Join(names, "+")
+
+		d, crash, err := analyzeSafely(roots, opts, index, redact)
+		if err != nil {
+			return err
+		}
+		if crash != nil {
+			if len(groups) == 1 {
+				return fmt.Errorf("%s could not be analyzed: %v", name, crash)
+			}
+			if opts.Progress != nil {
+				fmt.Fprintf(opts.Progress, "Warning: skipping %s, which could not be analyzed: %v\n", name, crash)
+			}
+			skipped = append(skipped, name)
+			continue
+		}
+		if basePkgs != nil {
+			old, err := diffBase(basePkgs, roots, opts, baseIndex)
+			if err != nil {
+				return err
+			}
+			d.diffAgainst(old)
+		}
+		d.Theme = th
+		if opts.Validate {
+			if err := validateMermaid(d); err != nil {
+				return fmt.Errorf("%s: invalid Mermaid: %v", roots[0].Name, err)
+			}
+		}
+		if opts.Complexity {
+			d.Comments = append(d.Comments, fmt.Sprintf("cyclomatic complexity: %d", d.Complexity))
+		}
+		write := func(w io.Writer) error {
+			bw := bufio.NewWriter(w)
+			if err := render(bw, d, opts); err != nil {
+				return err
+			}
+			if opts.WithSource {
+				for _, t := range roots {
+					fmt.Fprintf(bw, "\n```go\n%s\n```\n", funcSource(t))
+				}
+			}
+			return bw.Flush()
+		}
+		t := roots[0]
+		pkg := t.Pkg.PkgPath
+		if pkg == "" {
+			pkg = t.Pkg.Name
+		}
+		if redact != nil {
+			pkg = redact.pkg(pkg, t.Pkg.Name)
+		}
+		_, recv := redact.name(t)
+		r := Result{
+			Name:       name,
+			Receiver:   recv,
+			Package:    pkg,
+			Pos:        t.Pkg.Fset.Position(t.Decl.Pos()),
+			Complexity: d.Complexity,
+		}
+		if err := emit(r, emitted, len(groups), write); err != nil {
+			return err
+		}
+		emitted++
+	}
+	if len(skipped) > 0 {
+		if emitted == 0 {
+			return fmt.Errorf("none of the %d functions could be analyzed", len(skipped))
+		}
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "Skipped %d functions that could not be analyzed: %s\n", len(skipped), strings.Join(skipped, ", "))
+		}
+	}
+	return nil
+}
+
+// analyzeSafely runs analyzeCFG, returning what it panicked with, if it
+// did, as crash: in bulk runs one function cfg or flowgen can't handle
+// is skipped rather than ending the run.
+func analyzeSafely(roots []target, opts Options, index funcIndex, redact *redactor) (d *diagram, crash any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			d, crash, err = nil, r, nil
+		}
+	}()
+	d, err = analyzeCFG(roots, opts, index, redact)
+	return d, nil, err
+}
+
+// render writes d to w in opts.Format. Write errors are left for w's
+// Flush to report.
+func render(w *bufio.Writer, d *diagram, opts Options) error {
+	switch opts.Format {
+	case "dot":
+		renderDOT(w, d)
+	case "plantuml":
+		renderPlantUML(w, d)
+	case "svg":
+		return renderSVG(w, d)
+	case "state":
+		w.WriteString("```mermaid\n")
+		renderState(w, d)
+		w.WriteString("```\n")
+	default:
+		w.WriteString("```mermaid\n")
+		renderMermaid(w, d)
+		w.WriteString("```\n")
+	}
+	return nil
+}
+
+// Combine joins per-function diagrams into one document. Mermaid output,
+// flowchart or state diagram, gets a Markdown heading per function; DOT
+// and PlantUML files may simply hold several diagrams back to back.
+func Combine(results []Result, format string) string {
+	var buf bytes.Buffer
+	for i, r := range results {
+		buf.WriteString(combinedHeading(r, i, format))
+		buf.WriteString(r.Output)
+	}
+	return buf.String()
+}
+
+// combinedHeading is what a combined document puts before r, the i-th
+// diagram in it: a blank line after the one before and, in Markdown, a
+// heading.
+func combinedHeading(r Result, i int, format string) string {
+	var s string
+	if i > 0 {
+		s = "\n"
+	}
+	if format == "mermaid" || format == "state" || format == "" {
+		s += fmt.Sprintf("## %s\n\n", r.Name)
+	}
+	return s
+}
+
+// ==========================================
+// DEV MODE (Low-Level CFG)
+// ==========================================
+
+func loadPackages(opts Options) ([]*packages.Package, error) {
+	if opts.Source != nil {
+		src, err := io.ReadAll(opts.Source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read source: %v", err)
+		}
+		return parseSingleFile("<source>", src)
+	}
+	if info, err := os.Stat(opts.Dir); err == nil && !info.IsDir() {
+		return parseSingleFile(opts.Dir, nil)
+	}
+
+	config := &packages.Config{
+		Mode: packages.NeedName | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedFiles | packages.NeedCompiledGoFiles,
+		Dir:  opts.Dir,
+	}
+	config.Tests = opts.Tests
+	if opts.Overlay != "" {
+		overlay, err := readOverlay(opts.Overlay)
+		if err != nil {
+			return nil, err
+		}
+		config.Overlay = overlay
+	}
+	if opts.Tags != "" {
+		config.BuildFlags = []string{"-tags=" + opts.Tags}
+	}
+	if opts.GOOS != "" || opts.GOARCH != "" {
+		config.Env = os.Environ()
+		if opts.GOOS != "" {
+			config.Env = append(config.Env, "GOOS="+opts.GOOS)
+		}
+		if opts.GOARCH != "" {
+			config.Env = append(config.Env, "GOARCH="+opts.GOARCH)
+		}
+	}
+
+	if opts.Progress != nil {
+		dir := opts.Dir
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		fmt.Fprintf(opts.Progress, "Loading packages in %s...\n", dir)
+	}
+
+	// The context stops go list; type checking doesn't watch it, so the
+	// load also runs on its own goroutine and is abandoned on timeout.
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	config.Context = ctx
+
+	type loaded struct {
+		pkgs []*packages.Package
+		err  error
+	}
+	done := make(chan loaded, 1)
+	go func() {
+		pkgs, err := packages.Load(config, "./...")
+		done <- loaded{pkgs, err}
+	}()
+
+	var res loaded
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("loading packages timed out after %s", opts.Timeout)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("loading packages timed out after %s", opts.Timeout)
+	}
+	if res.err != nil || packages.PrintErrors(res.pkgs) > 0 {
+		return nil, fmt.Errorf("failed to load packages")
+	}
+	if opts.Tests {
+		return withoutTestDuplicates(res.pkgs), nil
+	}
+	return res.pkgs, nil
+}
+
+// readOverlay reads a go build -overlay file, {"Replace": {path: source}},
+// into file contents keyed by absolute path. Like go build, it resolves
+// relative paths against the working directory. Deleting a file, which
+// an empty source means to go build, can't be expressed this way.
+func readOverlay(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay: %v", err)
+	}
+	var spec struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid overlay %s: %v", path, err)
+	}
+	overlay := make(map[string][]byte)
+	for file, source := range spec.Replace {
+		if source == "" {
+			return nil, fmt.Errorf("overlay %s deletes %s, which flowgen doesn't support", path, file)
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read overlay source for %s: %v", file, err)
+		}
+		overlay[abs] = content
+	}
+	return overlay, nil
+}
+
+// withoutTestDuplicates drops what loading with tests adds twice: a
+// package that also has a test variant (whose files are a superset of its
+// own) and the generated test main packages.
+func withoutTestDuplicates(pkgs []*packages.Package) []*packages.Package {
+	variants := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if pkg.ID != pkg.PkgPath && strings.HasPrefix(pkg.ID, pkg.PkgPath+" [") {
+			variants[pkg.PkgPath] = true
+		}
+	}
+	var kept []*packages.Package
+	for _, pkg := range pkgs {
+		if strings.HasSuffix(pkg.PkgPath, ".test") || (pkg.ID == pkg.PkgPath && variants[pkg.PkgPath]) {
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	return kept
+}
+
+// parseSingleFile wraps one parsed file in a package with no type
+// information, for quick diagrams of a lone file or Options.Source.
+// Anything that needs TypesInfo must check for nil and skip.
+func parseSingleFile(filename string, src []byte) ([]*packages.Package, error) {
+	fset := token.NewFileSet()
+	var source any
+	if src != nil {
+		source = src
+	}
+	file, err := parser.ParseFile(fset, filename, source, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+
+	pkg := &packages.Package{
+		Name:   file.Name.Name,
+		Fset:   fset,
+		Syntax: []*ast.File{file},
+	}
+	return []*packages.Package{pkg}, nil
+}
+
+// analyzeCFG draws the flow of each root function from its own ROOT node.
+// With several roots, each is framed in a subgraph and their node IDs are
+// prefixed R1_, R2_ and so on; a root the others call is linked to rather
+// than expanded again.
+func analyzeCFG(roots []target, opts Options, index funcIndex, redact *redactor) (*diagram, error) {
+	noise, err := newNoiseFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diagram{Direction: opts.Direction}
+	fb := &flowBuilder{d: d, opts: opts, noise: noise, index: index, redact: redact, expanded: make(map[*types.Func]string), external: make(map[*types.Func]string)}
+	if index != nil {
+		fb.local = index.packages()
+	}
+	fb.roots = make(map[*ast.FuncDecl]bool)
+	for _, t := range roots {
+		fb.roots[t.Decl] = true
+	}
+	if opts.FromLine > 0 || opts.ToLine > 0 {
+		fb.cut = make(map[string]bool)
+	}
+
+	calls := make([][]callSite, len(roots))
+	for i, t := range roots {
+		prefix := ""
+		if len(roots) > 1 {
+			prefix = fmt.Sprintf("R%d_", i+1)
+		}
+		first := len(d.Nodes)
+		d.addNode(prefix+"ROOT", fb.title(t), shapeStadium, "root")
+		entry, sites, complexity := fb.addFunction(t, prefix)
+		d.addEdge(&edge{From: prefix + "ROOT", To: entry})
+		d.splitParts(d.Nodes[first:], opts.SplitAt, prefix)
+		d.Complexity += complexity
+		calls[i] = sites
+
+		if fn := index.lookup(t); fn != nil {
+			fb.expanded[fn] = entry
+		}
+		if len(roots) > 1 {
+			var ids []string
+			for _, n := range d.Nodes[first:] {
+				ids = append(ids, n.ID)
+			}
+			d.addSubgraph(prefix+"fn", fb.title(t), ids)
+		}
+	}
+	for i, sites := range calls {
+		fb.expandEntry(roots[i].Pkg.Types, sites)
+	}
+	if len(fb.cut) > 0 {
+		d.cutNodes(fb.cut)
+	}
+	if len(d.Packages) > 0 {
+		var ids []string
+		for _, pkg := range d.Packages {
+			d.addNode("LEGEND_"+pkg, pkg, shapeBox, "pkg_"+pkg)
+			ids = append(ids, "LEGEND_"+pkg)
+		}
+		d.addSubgraph("legend", "Packages called", ids)
+	}
+
+	if opts.Collapse {
+		d.collapseChains()
+	}
+	if opts.Highlight != "" {
+		d.highlight(opts.Highlight)
+	}
+	if !opts.Nest {
+		d.groupLoops()
+	}
+	d.nestSubgraphs()
+	if opts.Sort == "topo" {
+		d.sortTopological()
+	}
+	if opts.StableIDs {
+		d.stableIDs()
+	}
+	if opts.NoRoot {
+		d.dropRoots()
+	}
+	if opts.Legend {
+		d.addLegend()
+	}
+	return d, nil
+}
+
+// colorByPackage gives node id the class of the package, other than the
+// function's own, that nodes call into most often; the first to reach
+// that count wins a tie. Calls inside function literals don't count.
+func (fb *flowBuilder) colorByPackage(id string, nodes []ast.Node, own *types.Package, info *types.Info) {
+	if !fb.opts.ColorByPackage || info == nil {
+		return
+	}
+	counts := make(map[string]int)
+	best := ""
+	for _, n := range nodes {
+		ast.Inspect(n, func(x ast.Node) bool {
+			switch x := x.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if fn := calleeOf(x, info); fn != nil && fn.Pkg() != nil && fn.Pkg() != own {
+					name := fb.redact.pkg(fn.Pkg().Path(), fn.Pkg().Name())
+					counts[name]++
+					if counts[name] > counts[best] {
+						best = name
+					}
+				}
+			}
+			return true
+		})
+	}
+	n := fb.d.node(id)
+	if best == "" || n == nil {
+		return
+	}
+	n.ExtraClasses = append(n.ExtraClasses, "pkg_"+best)
+	for _, pkg := range fb.d.Packages {
+		if pkg == best {
+			return
+		}
+	}
+	fb.d.Packages = append(fb.d.Packages, best)
+}
+
+// nest frames the nodes drawn from each if, for, switch and select
+// statement in t in a subgraph titled after it, e.g. "if n > 0", so the
+// diagram keeps the block structure of the source; nested statements give
+// nested subgraphs. A node belongs to the statement its source position
+// lies in. Statements drawn as a single node get no frame.
+func (fb *flowBuilder) nest(t target, prefix string, positions map[string]token.Pos) {
+	defer fb.redact.hide(t.Decl.Body)()
+	fset := t.Pkg.Fset
+	count := 0
+	ast.Inspect(t.Decl.Body, func(x ast.Node) bool {
+		var title string
+		switch s := x.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt:
+			title = "if " + printRawNode(fset, s.Cond)
+		case *ast.ForStmt:
+			title = "for"
+			if s.Cond != nil {
+				title += " " + printRawNode(fset, s.Cond)
+			}
+		case *ast.RangeStmt:
+			title = "for range " + printRawNode(fset, s.X)
+		case *ast.SwitchStmt:
+			title = "switch"
+			if s.Tag != nil {
+				title += " " + printRawNode(fset, s.Tag)
+			}
+		case *ast.TypeSwitchStmt:
+			title = "switch " + printRawNode(fset, s.Assign)
+		case *ast.SelectStmt:
+			title = "select"
+		default:
+			return true
+		}
+		var ids []string
+		for _, n := range fb.d.Nodes {
+			if pos, ok := positions[n.ID]; ok && pos >= x.Pos() && pos < x.End() {
+				ids = append(ids, n.ID)
+			}
+		}
+		if len(ids) > 1 {
+			count++
+			fb.d.addSubgraph(fmt.Sprintf("%snest%d", prefix, count), truncateLabel(strings.Join(strings.Fields(title), " "), 40), ids)
+		}
+		return true
+	})
+}
+
+// flowBuilder adds functions' control flow to a diagram. Each function's
+// node IDs carry a prefix so expanded callees don't collide.
+type flowBuilder struct {
+	d        *diagram
+	opts     Options
+	noise    *noiseFilter
+	index    funcIndex
+	expanded map[*types.Func]string // callee -> entry node ID
+	external map[*types.Func]string // callee outside the loaded packages -> its node ID
+	local    map[*types.Package]bool
+	redact   *redactor // set with -redact; collects the identifiers of each function added
+	roots    map[*ast.FuncDecl]bool
+	cut      map[string]bool // with -from-line or -to-line, root nodes outside the lines
+	next     int
+}
+
+// newCFG builds a function body's control-flow graph. Tests swap it out to
+// reach graphs cfg itself never returns.
+var newCFG = cfg.New
+
+// addFunction adds the blocks of t's body and returns the ID of the node
+// flow enters at, the calls into other functions it found, and its
+// cyclomatic complexity.
+func (fb *flowBuilder) addFunction(t target, prefix string) (string, []callSite, int) {
+	d := fb.d
+	opts := fb.opts
+	fset := t.Pkg.Fset
+	info := t.Pkg.TypesInfo
+	if fb.redact != nil {
+		fb.redact.collect(t.Decl, info)
+	}
+
+	// An empty body, comments aside, has nothing to draw but its end.
+	if len(t.Decl.Body.List) == 0 {
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "Note: %s has an empty body\n", t.Name)
+		}
+		d.addNode(prefix+"END", "End", shapeStadium, "endNode")
+		return prefix + "END", nil, 1
+	}
+
+	flowGraph := newCFG(t.Decl.Body, func(call *ast.CallExpr) bool { return !isBuiltinCall(call, "panic", info) })
+	// cfg always starts a body with an entry block, but should a
+	// degenerate one come back without any, it is drawn as going
+	// straight to its end rather than indexing a block that isn't there.
+	if len(flowGraph.Blocks) == 0 {
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "Note: no control flow could be built for %s\n", t.Name)
+		}
+		d.addNode(prefix+"END", "End", shapeStadium, "endNode")
+		return prefix + "END", nil, 1
+	}
+	var self *types.Func
+	if info != nil {
+		self, _ = info.Defs[t.Decl.Name].(*types.Func)
+	}
+	recovers := deferredRecovers(t.Decl.Body, info)
+	guardDefer, guard := recoverGuard(t.Decl.Body, info)
+	jumps := branchBlocks(t.Decl.Body, flowGraph.Blocks)
+	firstNode := len(d.Nodes)
+	complexity := cyclomatic(flowGraph)
+
+	lbl := newLabeler(fset, t.Decl.Body, opts.MaxLabel)
+	lbl.lines = opts.Lines
+	lbl.shorten = opts.Shorten
+	lbl.compact = opts.Compact
+	lbl.redact = fb.redact
+	if opts.Comments {
+		if file := fileOf(t); file != nil {
+			lbl.addComments(file, t.Decl.Body)
+		}
+	}
+	if opts.IdiomaticErrors {
+		lbl.errInfo = info
+		lbl.errChecks = true
+	}
+	if opts.ResolveConsts {
+		lbl.consts = info
+	}
+	if opts.SyncHints {
+		lbl.syncInfo = info
+	}
+
+	noise := make(map[int32][]ast.Node)
+	for _, block := range flowGraph.Blocks {
+		if !opts.NoFilter {
+			block.Nodes, noise[block.Index] = filterNoise(block.Nodes, fb.noise, info)
+		}
+		stripRangeOperands(block)
+		lbl.stripSelectComms(block)
+	}
+
+	var deferred map[int32][]*ast.DeferStmt
+	if opts.Defers != "inline" {
+		deferred = extractDefers(flowGraph.Blocks)
+	}
+	// Panics the guard may catch lead to its own frame below, and the
+	// rest were raised before it was registered, so it gets no edge back
+	// from PANIC.
+	var guarded map[int32]bool
+	if guard != nil {
+		guarded = registeredIn(flowGraph.Blocks, guardDefer, deferred)
+		delete(recovers, guardDefer)
+	}
+	hidden := foldTypeCases(flowGraph.Blocks, lbl)
+	for _, block := range flowGraph.Blocks {
+		if sel, ok := lbl.selectHead(block); ok {
+			chain := lbl.selectChain(block)
+			for _, test := range chain[1:] {
+				hidden[test.Index] = true
+			}
+			// Without a default clause a select blocks until a case is
+			// ready, so cfg's fall-through past the last case never runs.
+			if !hasDefaultComm(sel) {
+				last := chain[len(chain)-1].Succs[1]
+				last.Succs = nil
+				hidden[last.Index] = true
+			}
+		}
+	}
+
+	// An if/else-if chain fans out from a single decision, each edge naming
+	// its condition, instead of cascading through a diamond per test.
+	ladders := make(map[int32][]*cfg.Block)
+	for _, block := range flowGraph.Blocks {
+		if hidden[block.Index] {
+			continue
+		}
+		if chain := elseIfChain(block); chain != nil {
+			ladders[block.Index] = chain
+			for _, test := range chain[1:] {
+				hidden[test.Index] = true
+			}
+		}
+	}
+
+	// A three-clause for loop's post statement becomes the label on the
+	// edges that loop back, rather than a block of its own.
+	restore := fb.redact.hide(t.Decl.Body)
+	steps := foldForPosts(flowGraph.Blocks, fset)
+	restore()
+	for _, block := range flowGraph.Blocks {
+		if block.Kind == cfg.KindForPost && len(block.Succs) == 0 {
+			hidden[block.Index] = true
+		}
+	}
+
+	// -prune-returns sends every way out of the function to one shared End
+	// block. Return statements are dropped; a block left empty is bypassed.
+	var end *cfg.Block
+	if opts.PruneReturns {
+		end = pruneReturns(flowGraph, info)
+	}
+
+	// Build predecessor map to detect merge points
+	preds := make(map[int32][]int32)
+	for _, b := range flowGraph.Blocks {
+		for _, succ := range b.Succs {
+			preds[succ.Index] = append(preds[succ.Index], b.Index)
+		}
+	}
+
+	// Code nothing leads to, such as statements after a return, is drawn
+	// marked as such. The empty blocks cfg leaves behind a return, and any
+	// only they lead to, are dropped.
+	reachable := reachableBlocks(flowGraph.Blocks[0])
+	dead := make(map[int32]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, b := range flowGraph.Blocks {
+			if dead[b.Index] || reachable[b.Index] || len(b.Nodes) > 0 {
+				continue
+			}
+			allDead := true
+			for _, p := range preds[b.Index] {
+				allDead = allDead && dead[p]
+			}
+			if allDead {
+				dead[b.Index] = true
+				changed = true
+			}
+		}
+	}
+
+	back := backEdges(flowGraph.Blocks)
+	isBack := func(from, succ *cfg.Block) bool {
+		return isBackEdge(from, succ, preds, back)
+	}
+	var branches []ast.Node
+	for _, br := range jumps {
+		branches = append(branches, br)
+	}
+	jumpLabel := func(label string, from, succ *cfg.Block) string {
+		defer fb.redact.hide(branches...)()
+		label = withJump(label, jumpVia(from, succ, preds, jumps))
+		if step := stepVia(from, succ, preds, steps); step != "" {
+			if label == "" {
+				return step
+			}
+			return label + ", " + step
+		}
+		return label
+	}
+
+	loopHeaders := make(map[int32]bool)
+	for _, b := range flowGraph.Blocks {
+		if hidden[b.Index] || isEmptyPassThrough(b, preds) {
+			continue
+		}
+		for _, succ := range b.Succs {
+			if isBack(b, succ) {
+				loopHeaders[resolveDestination(succ, preds).Index] = true
+			}
+		}
+	}
+
+	// A conditional block with statements ahead of its condition is split
+	// into a setup box feeding the decision diamond. Type-switch cases and
+	// selects carry no condition node, so any statements there are setup.
+	// Otherwise only a block ending in a condition expression is split; a
+	// range header branches too but has no condition to pull out.
+	split := make(map[int32]bool)
+	for _, b := range flowGraph.Blocks {
+		if _, ok := lbl.decisionLabel(b); ok {
+			split[b.Index] = len(b.Nodes) > 0
+		} else if len(b.Nodes) > 1 && len(b.Succs) == 2 && b.Kind != cfg.KindRangeLoop {
+			_, isExpr := b.Nodes[len(b.Nodes)-1].(ast.Expr)
+			split[b.Index] = isExpr
+		}
+	}
+	entryOf := func(b *cfg.Block) string {
+		return prefix + getEntryPoint(b, split)
+	}
+	if opts.Debug != nil {
+		dumpBlocks(opts.Debug, t.Name, flowGraph.Blocks, preds, split, hidden, dead)
+	}
+
+	// annotate attaches what the label leaves out: the author's comments
+	// and, with -tooltips, the statements' full source.
+	annotate := func(n *node, nodes []ast.Node) {
+		n.Note = lbl.notes(nodes)
+		if opts.Tooltips || (opts.Compact && len(nodes) > 1) {
+			n.Tooltip = lbl.source(nodes)
+		}
+	}
+
+	// -from-line and -to-line keep the blocks of a root function with a
+	// statement in range; an empty block goes by the statement it belongs to.
+	slicing := fb.cut != nil && fb.roots[t.Decl]
+	inLines := func(b *cfg.Block) bool {
+		nodes := b.Nodes
+		if len(nodes) == 0 && b.Stmt != nil {
+			nodes = []ast.Node{b.Stmt}
+		}
+		for _, n := range nodes {
+			start, end := fset.Position(n.Pos()).Line, fset.Position(n.End()).Line
+			if (opts.ToLine == 0 || start <= opts.ToLine) && end >= opts.FromLine {
+				return true
+			}
+		}
+		return false
+	}
+
+	// -nest frames nodes by the statement their source lies in.
+	var positions map[string]token.Pos
+	if opts.Nest {
+		positions = make(map[string]token.Pos)
+	}
+
+	var calls []callSite
+	var panics, handlers, recovered []string
+	for _, block := range flowGraph.Blocks {
+		if hidden[block.Index] || dead[block.Index] || isEmptyPassThrough(block, preds) {
+			continue
+		}
+
+		before := len(d.Nodes)
+		id := fmt.Sprintf("%sB%d", prefix, block.Index)
+		isCond := len(block.Succs) == 2
+		decision, hasDecision := lbl.decisionLabel(block)
+		label := lbl.formatNodes(block.Nodes, isCond)
+
+		setupLen := 0
+		if split[block.Index] {
+			setupNodes := block.Nodes[:len(block.Nodes)-1]
+			condLabel := lbl.formatNodes(block.Nodes[len(block.Nodes)-1:], true)
+			if hasDecision {
+				setupNodes, condLabel = block.Nodes, decision
+			} else if ladders[block.Index] != nil {
+				condLabel = ladderLabel
+			}
+
+			setupShape := shapeBox
+			if opts.Shapes {
+				setupShape = statementShape(setupNodes)
+			}
+			setupLen = len(setupNodes)
+			annotate(d.addNode(id+"_setup", lbl.formatNodes(setupNodes, false), setupShape, ""), setupNodes)
+			annotate(d.addNode(id, condLabel, shapeDiamond, ""), block.Nodes[len(setupNodes):])
+			d.addEdge(&edge{From: id + "_setup", To: id})
+			calls = append(calls, fb.callSites(id+"_setup", setupNodes, info)...)
+			calls = append(calls, fb.callSites(id, block.Nodes[len(setupNodes):], info)...)
+			fb.colorByPackage(id+"_setup", setupNodes, t.Pkg.Types, info)
+			fb.colorByPackage(id, block.Nodes[len(setupNodes):], t.Pkg.Types, info)
+			fb.recursion(id+"_setup", prefix, setupNodes, self, info)
+			fb.recursion(id, prefix, block.Nodes[len(setupNodes):], self, info)
+			if containsAny(setupNodes, recovers) {
+				handlers = append(handlers, id+"_setup")
+			}
+		} else {
+			isMerge := false
+
+			if hasDecision {
+				label = decision
+			} else if ladders[block.Index] != nil {
+				label = ladderLabel
+			} else if loop, ok := countedLoop(block); ok {
+				label = lbl.loopLabel(loop.Cond)
+			} else if len(block.Nodes) == 0 {
+				if block.Kind == cfg.KindRangeLoop {
+					label = lbl.formatNodes([]ast.Node{block.Stmt}, false)
+				} else if loopHeaders[block.Index] && len(block.Succs) == 1 && resolveDestination(block.Succs[0], preds) == block {
+					label = "Loop forever"
+				} else if loopHeaders[block.Index] {
+					label = "Evaluate Loop Condition"
+				} else if len(preds[block.Index]) > 1 && len(block.Succs) == 1 {
+					label = "Merge"
+					isMerge = true
+				} else {
+					label = getStructuralLabel(block)
+				}
+			}
+
+			shape := shapeBox
+			if isCond {
+				shape = shapeDiamond
+			} else if isMerge {
+				shape = shapeCircle
+			}
+
+			panicking := endsInPanic(block, info)
+			class := ""
+			if len(block.Succs) == 0 && !panicking {
+				if isErrorReturn(block.Nodes, fset) {
+					class = "errorNode"
+				} else if isEarlyReturn(block, t.Decl.Body) {
+					class = "earlyReturn"
+				} else {
+					class = "successNode"
+				}
+			} else if isMerge {
+				class = "mergeNode"
+			}
+			if block == end {
+				label, shape, class = "End", shapeStadium, "endNode"
+			} else if opts.Shapes && shape == shapeBox {
+				shape = statementShape(block.Nodes)
+			}
+
+			n := d.addNode(id, label, shape, class)
+			if block.Kind == cfg.KindRangeLoop {
+				annotate(n, []ast.Node{block.Stmt})
+			} else {
+				annotate(n, block.Nodes)
+			}
+			calls = append(calls, fb.callSites(id, block.Nodes, info)...)
+			fb.colorByPackage(id, block.Nodes, t.Pkg.Types, info)
+			fb.recursion(id, prefix, block.Nodes, self, info)
+			if panicking && guarded[block.Index] {
+				recovered = append(recovered, id)
+			} else if panicking {
+				panics = append(panics, id)
+			}
+			if containsAny(block.Nodes, recovers) {
+				handlers = append(handlers, id)
+			}
+		}
+
+		if !reachable[block.Index] {
+			for _, nid := range []string{id + "_setup", id} {
+				if n := d.node(nid); n != nil {
+					n.Class = "unreachableNode"
+					n.Note = strings.TrimSuffix("(unreachable)\n"+n.Note, "\n")
+				}
+			}
+		}
+
+		// A goroutine gets its own node, forked off the node holding the go
+		// statement; it doesn't rejoin the flow.
+		for i, n := range block.Nodes {
+			if g, ok := n.(*ast.GoStmt); ok {
+				goID := fmt.Sprintf("%s_go%d", id, i)
+				from := id
+				if i < setupLen {
+					from = id + "_setup"
+				}
+				restore := fb.redact.hide(g)
+				d.addNode(goID, wrapText(truncateLabel(goroutineCall(fset, g), opts.MaxLabel), 35), shapeBox, "goroutineNode")
+				restore()
+				d.addEdge(&edge{From: from, To: goID, Label: "go", Fork: true})
+			}
+		}
+
+		// -show-noise hangs what the filter dropped off the block as a
+		// muted side note, so it stays out of the flow.
+		if opts.ShowNoise && len(noise[block.Index]) > 0 {
+			d.addNode(id+"_noise", lbl.formatNodes(noise[block.Index], false), shapeBox, "noiseNode")
+			d.addEdge(&edge{From: id, To: id + "_noise", Aside: true})
+		}
+
+		if len(block.Succs) == 1 {
+			dest := resolveDestination(block.Succs[0], preds)
+			d.addEdge(&edge{From: id, To: entryOf(dest), Label: jumpLabel("", block, block.Succs[0]), Back: isBack(block, block.Succs[0])})
+
+		} else if sel, ok := lbl.selectHead(block); ok {
+			var last *cfg.Block
+			for _, test := range lbl.selectChain(block) {
+				body := test.Succs[0]
+				dest := resolveDestination(body, preds)
+				comm := lbl.describeChannelOp(body.Stmt.(*ast.CommClause).Comm)
+				d.addEdge(&edge{From: id, To: entryOf(dest), Label: jumpLabel(comm, test, body), Back: isBack(test, body)})
+				last = test
+			}
+			if hasDefaultComm(sel) {
+				dest := resolveDestination(last.Succs[1], preds)
+				d.addEdge(&edge{From: id, To: entryOf(dest), Label: jumpLabel("Default", last, last.Succs[1]), Back: isBack(last, last.Succs[1])})
+			}
+
+		} else if ladder := ladders[block.Index]; ladder != nil {
+			for _, test := range ladder {
+				cond := strings.TrimSuffix(lbl.formatNodes(test.Nodes[len(test.Nodes)-1:], true), "?")
+				dest := resolveDestination(test.Succs[0], preds)
+				d.addEdge(&edge{From: id, To: entryOf(dest), Label: jumpLabel(cond, test, test.Succs[0]), Back: isBack(test, test.Succs[0])})
+			}
+			last := ladder[len(ladder)-1]
+			dest := resolveDestination(last.Succs[1], preds)
+			d.addEdge(&edge{From: id, To: entryOf(dest), Label: jumpLabel("otherwise", last, last.Succs[1]), Back: isBack(last, last.Succs[1])})
+
+		} else if len(block.Succs) == 2 {
+			destTrue := resolveDestination(block.Succs[0], preds)
+			destFalse := resolveDestination(block.Succs[1], preds)
+
+			labelTrue, labelFalse := opts.TrueLabel, opts.FalseLabel
+			if _, counted := countedLoop(block); counted || block.Kind == cfg.KindRangeLoop {
+				labelTrue, labelFalse = opts.LoopLabel, "Done"
+			} else if lbl.isSwitchDefault(block.Succs[1]) {
+				labelFalse = "otherwise"
+			} else if opts.IdiomaticErrors && len(block.Nodes) > 0 {
+				if _, failed, ok := lbl.errorCheck(block.Nodes[len(block.Nodes)-1]); ok {
+					labelTrue, labelFalse = "on error", "success"
+					if !failed {
+						labelTrue, labelFalse = labelFalse, labelTrue
+					}
+				}
+			}
+
+			d.addEdge(&edge{From: id, To: entryOf(destTrue), Label: jumpLabel(labelTrue, block, block.Succs[0]), Back: isBack(block, block.Succs[0])})
+			d.addEdge(&edge{From: id, To: entryOf(destFalse), Label: jumpLabel(labelFalse, block, block.Succs[1]), Back: isBack(block, block.Succs[1]), Long: loopHeaders[block.Index]})
+		}
+
+		if slicing && !inLines(block) {
+			for _, n := range d.Nodes[before:] {
+				fb.cut[n.ID] = true
+			}
+		}
+		if positions != nil {
+			pos := token.NoPos
+			if len(block.Nodes) > 0 {
+				pos = block.Nodes[len(block.Nodes)-1].Pos()
+			} else if block.Stmt != nil {
+				pos = block.Stmt.Pos()
+			}
+			for _, n := range d.Nodes[before:] {
+				positions[n.ID] = pos
+			}
+			if split[block.Index] {
+				positions[id+"_setup"] = block.Nodes[0].Pos()
+			}
+			for i, n := range block.Nodes {
+				if _, ok := n.(*ast.GoStmt); ok {
+					positions[fmt.Sprintf("%s_go%d", id, i)] = n.Pos()
+				}
+			}
+		}
+	}
+
+	// A panic leaves the normal flow for a shared PANIC exit. Where a
+	// deferred call recovers, a dashed edge leads back to where that
+	// handler was registered; with -defers end or hide it isn't drawn on
+	// its own, so the edge is left out.
+	if len(panics) > 0 {
+		d.addNode(prefix+"PANIC", "PANIC", shapeStadium, "errorNode")
+		for _, id := range panics {
+			d.addEdge(&edge{From: id, To: prefix + "PANIC", Panic: true})
+		}
+		for _, id := range handlers {
+			d.addEdge(&edge{From: prefix + "PANIC", To: id, Label: "recover", Recover: true})
+		}
+	}
+
+	// A deferred "if r := recover(); r != nil" guard catches the panics
+	// raised once it may have been registered. Its two outcomes get their
+	// own frame, entered by a dashed edge from each panic it catches.
+	if len(recovered) > 0 {
+		check := prefix + "RECOVER"
+		d.addNode(check, lbl.formatNodes([]ast.Node{guard.Cond}, true), shapeDiamond, "")
+		caught := d.addNode(prefix+"RECOVERED", "Panic recovered", shapeStadium, "deferNode")
+		var body []ast.Node
+		for _, stmt := range guard.Body.List {
+			body = append(body, stmt)
+		}
+		if len(body) > 0 {
+			caught.Note = lbl.formatNodes(body, false)
+		}
+		d.addNode(prefix+"NORMAL", "Normal return", shapeStadium, "successNode")
+		d.addEdge(&edge{From: check, To: prefix + "RECOVERED", Label: opts.TrueLabel})
+		d.addEdge(&edge{From: check, To: prefix + "NORMAL", Label: opts.FalseLabel})
+		d.addSubgraph(prefix+"recover", "Deferred recover", []string{check, prefix + "RECOVERED", prefix + "NORMAL"})
+		for _, id := range recovered {
+			d.addEdge(&edge{From: id, To: check, Label: "panic", Panic: true, Recover: true})
+		}
+	}
+
+	// With -defers end, each way out runs the deferred calls registered on
+	// the way to it, last registered first. A panic runs them too; the
+	// shared PANIC exit lists every call any panicking path registered.
+	if opts.Defers == "end" && len(deferred) > 0 {
+		pending := pendingDefers(flowGraph.Blocks, deferred)
+		exits := make(map[string][]*ast.DeferStmt)
+		for _, b := range flowGraph.Blocks {
+			if len(b.Succs) > 0 || hidden[b.Index] {
+				continue
+			}
+			id := fmt.Sprintf("%sB%d", prefix, b.Index)
+			if endsInPanic(b, info) {
+				id = prefix + "PANIC"
+			}
+			exits[id] = mergeDefers(exits[id], pending[b.Index])
+		}
+		d.insertBeforeTerminals(d.Nodes[firstNode:], "_defers", func(n *node) string {
+			if len(exits[n.ID]) == 0 {
+				return ""
+			}
+			lines := []string{"Deferred (LIFO):"}
+			for _, ds := range exits[n.ID] {
+				lines = append(lines, lbl.formatNodes([]ast.Node{ds.Call}, false))
+			}
+			return strings.Join(lines, "\n")
+		}, "deferNode")
+	}
+
+	if slicing {
+		var kept []callSite
+		for _, c := range calls {
+			if !fb.cut[c.From] {
+				kept = append(kept, c)
+			}
+		}
+		calls = kept
+		for _, n := range d.Nodes[firstNode:] {
+			if base := strings.TrimSuffix(n.ID, "_defers"); base != n.ID && fb.cut[base] {
+				fb.cut[n.ID] = true
+			}
+		}
+	}
+
+	if positions != nil {
+		fb.nest(t, prefix, positions)
+	}
+
+	// -merge-returns draws identical ways out, such as several "return
+	// nil", once. Call sites stay apart so expansion can still attach to
+	// them, and a node cut by line slicing never absorbs a kept one.
+	if opts.MergeReturns {
+		apart := make(map[string]bool)
+		for _, c := range calls {
+			apart[c.From] = true
+		}
+		d.mergeTerminals(d.Nodes[firstNode:], apart, fb.cut)
+	}
+
+	return entryOf(resolveDestination(flowGraph.Blocks[0], preds)), calls, complexity
+}
+
+// ==========================================
+// UTILITIES
+// ==========================================
+
+func findStartingFunction(pkgs []*packages.Package, startParam string) (target, error) {
+	pkgPath, rest := splitPkgPath(pkgs, startParam)
+	targetRecv, targetName := parseStartParam(rest)
+
+	var matches []target
+	recvSeen := false
+	for _, pkg := range pkgs {
+		if pkgPath != "" && pkg.PkgPath != pkgPath {
+			continue
+		}
+		for _, file := range pkg.Syntax {
+			if isMockFile(pkg, file) {
+				continue
+			}
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok {
+					continue
+				}
+				recv := receiverName(pkg.Fset, fn)
+				if targetRecv != "" && recv == targetRecv {
+					recvSeen = true
+				}
+				if fn.Name.Name != targetName || (targetRecv != "" && recv != targetRecv) {
+					continue
+				}
+				matches = append(matches, target{Name: funcDisplayName(pkg.Fset, fn), Decl: fn, Pkg: pkg})
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		if targetRecv != "" {
+			if !recvSeen && !typeExists(pkgs, targetRecv) {
+				return target{}, fmt.Errorf("receiver type '%s' not found", targetRecv)
+			}
+			return target{}, fmt.Errorf("type '%s' has no method '%s'", targetRecv, targetName)
+		}
+		return target{}, fmt.Errorf("function '%s' not found (ignored auto-generated mocks)", startParam)
+	}
+
+	// A bare name prefers the plain function; if it only matches methods,
+	// they must be disambiguated by receiver.
+	if targetRecv == "" {
+		var plain []target
+		for _, m := range matches {
+			if m.Decl.Recv == nil {
+				plain = append(plain, m)
+			}
+		}
+		if len(plain) > 0 {
+			matches = plain
+		}
+	}
+	if len(matches) > 1 {
+		return target{}, ambiguousStart(startParam, matches)
+	}
+	return matches[0], nil
+}
+
+// findInits returns every init function -start names, when it names init,
+// in the order they are declared. Each is named after where it is, e.g.
+// "init (db.go line 12)", with the package path too when they span
+// several packages.
+func findInits(pkgs []*packages.Package, startParam string) []target {
+	pkgPath, rest := splitPkgPath(pkgs, startParam)
+	if rest != "init" {
+		return nil
+	}
+
+	var inits []target
+	for _, pkg := range pkgs {
+		if pkgPath != "" && pkg.PkgPath != pkgPath {
+			continue
+		}
+		for _, file := range pkg.Syntax {
+			if isMockFile(pkg, file) {
+				continue
+			}
+			for _, decl := range file.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "init" && fn.Body != nil {
+					inits = append(inits, target{Decl: fn, Pkg: pkg})
+				}
+			}
+		}
+	}
+
+	byPkg := false
+	for _, t := range inits {
+		byPkg = byPkg || t.Pkg.PkgPath != inits[0].Pkg.PkgPath
+	}
+	for i, t := range inits {
+		pos := t.Pkg.Fset.Position(t.Decl.Pos())
+		where := filepath.Base(pos.Filename)
+		if byPkg {
+			where = t.Pkg.PkgPath + "/" + where
+		}
+		inits[i].Name = fmt.Sprintf("init (%s line %d)", where, pos.Line)
+	}
+	return inits
+}
+
+// splitPkgPath strips a leading loaded package path from -start, as in
+// "github.com/me/app/server.Run", preferring the longest path that fits.
+func splitPkgPath(pkgs []*packages.Package, startParam string) (pkgPath, rest string) {
+	for _, pkg := range pkgs {
+		if strings.HasPrefix(startParam, pkg.PkgPath+".") && len(pkg.PkgPath) > len(pkgPath) {
+			pkgPath = pkg.PkgPath
+		}
+	}
+	if pkgPath == "" {
+		return "", startParam
+	}
+	return pkgPath, strings.TrimPrefix(startParam, pkgPath+".")
+}
+
+// ambiguousStart lists the candidates a -start value matched, qualified
+// by package path when they come from more than one package.
+func ambiguousStart(startParam string, matches []target) error {
+	byPkg := false
+	for _, m := range matches {
+		if m.Pkg.PkgPath != matches[0].Pkg.PkgPath {
+			byPkg = true
+		}
+	}
+
+	var names []string
+	for _, m := range matches {
+		if byPkg {
+			names = append(names, m.Pkg.PkgPath+"."+m.Name)
+		} else {
+			names = append(names, m.Name)
+		}
+	}
+	if byPkg {
+		return fmt.Errorf("'%s' is ambiguous, qualify it with a package path: %s", startParam, strings.Join(names, ", "))
+	}
+	return fmt.Errorf("'%s' is ambiguous, qualify it with a receiver: %s", startParam, strings.Join(names, ", "))
+}
+
+// parseStartParam splits -start into receiver type and function name,
+// accepting "Func", "Type.Method", "*Type.Method" and "(*Type).Method".
+func parseStartParam(startParam string) (recv, name string) {
+	if strings.HasPrefix(startParam, "(") {
+		if end := strings.Index(startParam, ")"); end > 0 {
+			recv = strings.TrimPrefix(startParam[1:end], "*")
+			name = strings.TrimPrefix(startParam[end+1:], ".")
+			return recv, name
+		}
+	}
+
+	parts := strings.Split(startParam, ".")
+	if len(parts) == 2 {
+		return strings.TrimPrefix(parts[0], "*"), parts[1]
+	}
+	return "", startParam
+}
+
+func typeExists(pkgs []*packages.Package, name string) bool {
+	for _, pkg := range pkgs {
+		if pkg.Types == nil {
+			continue
+		}
+		if _, ok := pkg.Types.Scope().Lookup(name).(*types.TypeName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allFunctions returns every function and method with a body, skipping
+// mocks and body-less declarations (assembly or linkname stubs).
+func allFunctions(pkgs []*packages.Package) []target {
+	var targets []target
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Syntax {
+			if isMockFile(pkg, file) {
+				continue
+			}
+			for _, decl := range file.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Body != nil {
+					targets = append(targets, target{Name: funcDisplayName(pkg.Fset, fn), Decl: fn, Pkg: pkg})
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// findByPosition returns the function whose declaration, doc comment
+// included, encloses pos, given as file.go:line:col or file.go:line, as
+// an editor would for the function under the cursor. A relative file is
+// taken from the working directory, or failing that from dir.
+func findByPosition(pkgs []*packages.Package, pos, dir string) (target, error) {
+	file, line, col, err := parsePosition(pos)
+	if err != nil {
+		return target{}, err
+	}
+	if _, err := os.Stat(file); err != nil && !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+
+	before := func(l1, c1, l2, c2 int) bool {
+		return l1 < l2 || (l1 == l2 && c1 <= c2)
+	}
+	found := false
+	for _, t := range allFunctions(pkgs) {
+		start, end := t.Pkg.Fset.Position(t.Decl.Pos()), t.Pkg.Fset.Position(t.Decl.End())
+		if t.Decl.Doc != nil {
+			start = t.Pkg.Fset.Position(t.Decl.Doc.Pos())
+		}
+		if filepath.Clean(start.Filename) != file {
+			continue
+		}
+		found = true
+		if col == 0 && start.Line <= line && line <= end.Line {
+			return t, nil
+		}
+		if col > 0 && before(start.Line, start.Column, line, col) && before(line, col, end.Line, end.Column) {
+			return t, nil
+		}
+	}
+	if !found {
+		return target{}, fmt.Errorf("-pos %s: %s declares no functions in the loaded packages", pos, file)
+	}
+	return target{}, fmt.Errorf("-pos %s: no function encloses that position", pos)
+}
+
+// parsePosition splits file.go:line:col, or file.go:line with col left
+// 0, reading from the right so a Windows drive letter stays in the file.
+func parsePosition(pos string) (file string, line, col int, err error) {
+	invalid := fmt.Errorf("invalid -pos '%s' (expected file.go:line:col)", pos)
+	var nums []int
+	rest := pos
+	for len(nums) < 2 {
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(rest[i+1:])
+		if err != nil || n <= 0 {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		rest = rest[:i]
+	}
+	if len(nums) == 0 || rest == "" {
+		return "", 0, 0, invalid
+	}
+	line = nums[0]
+	if len(nums) == 2 {
+		col = nums[1]
+	}
+	return rest, line, col, nil
+}
+
+// fileOf returns the file t is declared in.
+func fileOf(t target) *ast.File {
+	for _, f := range t.Pkg.Syntax {
+		if f.Pos() <= t.Decl.Pos() && t.Decl.End() <= f.End() {
+			return f
+		}
+	}
+	return nil
+}
+
+// funcSource prints t's declaration, doc comment and inner comments
+// included, as gofmt would lay it out.
+func funcSource(t target) string {
+	var node interface{} = t.Decl
+	if file := fileOf(t); file != nil {
+		node = &printer.CommentedNode{Node: t.Decl, Comments: file.Comments}
+	}
+	var b bytes.Buffer
+	conf := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if err := conf.Fprint(&b, t.Pkg.Fset, node); err != nil {
+		return printRawNode(t.Pkg.Fset, t.Decl)
+	}
+	return b.String()
+}
+
+func isMockFile(pkg *packages.Package, file *ast.File) bool {
+	filename := strings.ToLower(pkg.Fset.Position(file.Pos()).Filename)
+	return strings.Contains(filename, "mock")
+}
+
+// receiverName returns the receiver type of a method without its pointer
+// star or type parameters, or "" for plain functions.
+func receiverName(fset *token.FileSet, fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+	recv := strings.TrimPrefix(printRawNode(fset, fn.Recv.List[0].Type), "*")
+	if i := strings.Index(recv, "["); i >= 0 {
+		recv = recv[:i]
+	}
+	return recv
+}
+
+func funcDisplayName(fset *token.FileSet, fn *ast.FuncDecl) string {
+	if recv := receiverName(fset, fn); recv != "" {
+		return recv + "." + fn.Name.Name
+	}
+	return fn.Name.Name
+}
+
+// funcTitle heads a function's diagram. Type parameters are listed by
+// name only, without their constraints: "func Map[T, U]" or
+// "func Stack[T].Push".
+func funcTitle(fset *token.FileSet, fn *ast.FuncDecl) string {
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		recv := strings.TrimPrefix(printRawNode(fset, fn.Recv.List[0].Type), "*")
+		return "func " + recv + "." + fn.Name.Name
+	}
+	title := "func " + fn.Name.Name
+	if fn.Type.TypeParams != nil {
+		var names []string
+		for _, f := range fn.Type.TypeParams.List {
+			for _, name := range f.Names {
+				names = append(names, name.Name)
+			}
+		}
+		title += "[" + strings.Join(names, ", ") + "]"
+	}
+	return title
+}
+
+// title is funcTitle for t, with its names hidden under -redact.
+func (fb *flowBuilder) title(t target) string {
+	if fb.redact != nil {
+		fb.redact.collect(t.Decl, t.Pkg.TypesInfo)
+		defer fb.redact.hide(signature(t.Decl)...)()
+	}
+	return funcTitle(t.Pkg.Fset, t.Decl)
+}
+
+// labeler turns a function's CFG nodes into label text. Besides the file
+// set it carries context a lone node can't provide, such as which
+// expressions are the tag or case values of a switch statement.
+type labeler struct {
+	fset         *token.FileSet
+	maxLabel     int
+	lines        bool
+	shorten      int                 // with -shorten, how many trailing names of a selector chain to keep
+	compact      bool                // summarize a block of several statements as its last one, with -compact
+	comments     map[ast.Node]string // author comments by the CFG node they explain, with -comments
+	errChecks    bool                // phrase err != nil checks as "Check err" with on error/success edges
+	errInfo      *types.Info         // types for errChecks; nil falls back to the name err
+	consts       *types.Info         // with -resolve-consts, types to show named constants' values from
+	syncInfo     *types.Info         // with -sync-hints, types to recognize sync.Mutex and sync.WaitGroup calls by
+	switches     map[ast.Node]*ast.SwitchStmt
+	typeSwitches map[ast.Node]*ast.TypeSwitchStmt // keyed by Assign statement and case clauses
+	selects      map[ast.Node]*ast.SelectStmt     // keyed by comm clauses and their comm statements
+	body         *ast.BlockStmt
+	redact       *redactor // with -redact, hides body's identifiers while a label is phrased
+}
+
+func newLabeler(fset *token.FileSet, body *ast.BlockStmt, maxLabel int) *labeler {
+	l := &labeler{
+		fset:         fset,
+		maxLabel:     maxLabel,
+		body:         body,
+		switches:     make(map[ast.Node]*ast.SwitchStmt),
+		typeSwitches: make(map[ast.Node]*ast.TypeSwitchStmt),
+		selects:      make(map[ast.Node]*ast.SelectStmt),
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch sw := n.(type) {
+		case *ast.SwitchStmt:
+			if sw.Tag != nil {
+				l.switches[sw.Tag] = sw
+			}
+			for _, stmt := range sw.Body.List {
+				for _, expr := range stmt.(*ast.CaseClause).List {
+					l.switches[expr] = sw
+				}
+			}
+		case *ast.TypeSwitchStmt:
+			l.typeSwitches[sw.Assign] = sw
+			for _, stmt := range sw.Body.List {
+				l.typeSwitches[stmt] = sw
+			}
+		case *ast.SelectStmt:
+			for _, stmt := range sw.Body.List {
+				cc := stmt.(*ast.CommClause)
+				l.selects[cc] = sw
+				if cc.Comm != nil {
+					l.selects[cc.Comm] = sw
+				}
+			}
+		}
+		return true
+	})
+	return l
+}
+
+// decisionLabel returns the label for a branching block whose decision
+// isn't an expression in the block itself: type-switch cases and selects.
+func (l *labeler) decisionLabel(b *cfg.Block) (string, bool) {
+	defer l.redact.hide(l.body)()
+	if label, ok := l.typeCaseLabel(b); ok {
+		return label, true
+	}
+	if _, ok := l.selectHead(b); ok {
+		return "Select", true
+	}
+	return "", false
+}
+
+// selectHead reports whether b is where a select statement starts choosing
+// between its cases: the test for its first communication clause.
+func (l *labeler) selectHead(b *cfg.Block) (*ast.SelectStmt, bool) {
+	if len(b.Succs) != 2 || b.Succs[0].Kind != cfg.KindSelectCaseBody {
+		return nil, false
+	}
+	cc, ok := b.Succs[0].Stmt.(*ast.CommClause)
+	if !ok {
+		return nil, false
+	}
+	sel := l.selects[cc]
+	for _, stmt := range sel.Body.List {
+		if stmt.(*ast.CommClause).Comm != nil {
+			return sel, stmt == cc
+		}
+	}
+	return nil, false
+}
+
+// selectChain returns the per-clause tests cfg chains together for the
+// select starting at head, head included.
+func (l *labeler) selectChain(head *cfg.Block) []*cfg.Block {
+	chain := []*cfg.Block{head}
+	for next := head.Succs[1]; next.Kind == cfg.KindSelectAfterCase && len(next.Succs) == 2; next = next.Succs[1] {
+		chain = append(chain, next)
+	}
+	return chain
+}
+
+// ladderLabel heads an if/else-if chain; its edges carry the conditions.
+const ladderLabel = "Which condition holds?"
+
+// elseIfChain returns the tests of the if/else-if chain starting at head,
+// head included, or nil when head doesn't start one. Each further test is
+// an else branch holding nothing but the next if's condition; an else-if
+// with its own init statement, or a condition cfg splits at && or ||, ends
+// the chain.
+func elseIfChain(head *cfg.Block) []*cfg.Block {
+	isTest := func(b *cfg.Block) bool {
+		if len(b.Succs) != 2 || b.Succs[0].Kind != cfg.KindIfThen || len(b.Nodes) == 0 {
+			return false
+		}
+		s, ok := b.Succs[0].Stmt.(*ast.IfStmt)
+		return ok && b.Nodes[len(b.Nodes)-1] == s.Cond
+	}
+	if !isTest(head) {
+		return nil
+	}
+
+	chain := []*cfg.Block{head}
+	for next := head.Succs[1]; next.Kind == cfg.KindIfElse && len(next.Nodes) == 1 && isTest(next); next = next.Succs[1] {
+		if s, ok := next.Succs[0].Stmt.(*ast.IfStmt); !ok || s.Init != nil {
+			break
+		}
+		chain = append(chain, next)
+	}
+	if len(chain) < 2 {
+		return nil
+	}
+	return chain
+}
+
+func hasDefaultComm(sel *ast.SelectStmt) bool {
+	for _, stmt := range sel.Body.List {
+		if stmt.(*ast.CommClause).Comm == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSelectComms drops the communication statements cfg evaluates ahead
+// of a select, and the received variable it repeats at the top of a case
+// body; the select's edges describe them instead.
+func (l *labeler) stripSelectComms(b *cfg.Block) {
+	var received ast.Node
+	if cc, ok := b.Stmt.(*ast.CommClause); ok && b.Kind == cfg.KindSelectCaseBody {
+		if a, ok := cc.Comm.(*ast.AssignStmt); ok {
+			received = a.Lhs[0]
+		}
+	}
+
+	var keep []ast.Node
+	for i, n := range b.Nodes {
+		if _, ok := l.selects[n]; ok {
+			continue
+		}
+		if i == 0 && n == received {
+			continue
+		}
+		keep = append(keep, n)
+	}
+	b.Nodes = keep
+}
+
+func isReceive(e ast.Expr) bool {
+	u, ok := e.(*ast.UnaryExpr)
+	return ok && u.Op == token.ARROW
+}
+
+// describeChannelOp phrases a channel send or receive statement:
+// "Send v to ch", "Receive from ch", "Receive from ch into v (ok)".
+func (l *labeler) describeChannelOp(n ast.Node) string {
+	defer l.redact.hide(l.body)()
+	switch x := n.(type) {
+	case *ast.SendStmt:
+		return fmt.Sprintf("Send %s to %s", printRawNode(l.fset, x.Value), printRawNode(l.fset, x.Chan))
+	case *ast.ExprStmt:
+		if recv, ok := x.X.(*ast.UnaryExpr); ok && recv.Op == token.ARROW {
+			return fmt.Sprintf("Receive from %s", printRawNode(l.fset, recv.X))
+		}
+	case *ast.AssignStmt:
+		if recv, ok := x.Rhs[0].(*ast.UnaryExpr); ok && recv.Op == token.ARROW {
+			result := fmt.Sprintf("Receive from %s", printRawNode(l.fset, recv.X))
+			if v := printRawNode(l.fset, x.Lhs[0]); v != "_" {
+				result += " into " + v
+			}
+			if len(x.Lhs) == 2 {
+				result += fmt.Sprintf(" (%s)", printRawNode(l.fset, x.Lhs[1]))
+			}
+			return result
+		}
+	}
+	return printRawNode(l.fset, n)
+}
+
+// typeSwitchSubject returns the expression a type switch inspects and the
+// variable it binds, if any.
+func typeSwitchSubject(ts *ast.TypeSwitchStmt) (subject ast.Expr, bound *ast.Ident) {
+	switch a := ts.Assign.(type) {
+	case *ast.AssignStmt:
+		bound, _ = a.Lhs[0].(*ast.Ident)
+		if ta, ok := a.Rhs[0].(*ast.TypeAssertExpr); ok {
+			subject = ta.X
+		}
+	case *ast.ExprStmt:
+		if ta, ok := a.X.(*ast.TypeAssertExpr); ok {
+			subject = ta.X
+		}
+	}
+	return subject, bound
+}
+
+// typeCaseLabel phrases the decision a type-switch case block makes. cfg
+// doesn't record case types in the block, so they are read from the
+// clause its true edge enters: "x is a *Foo?", "x is an int or int64?".
+func (l *labeler) typeCaseLabel(b *cfg.Block) (string, bool) {
+	if len(b.Succs) != 2 || b.Succs[0].Kind != cfg.KindSwitchCaseBody {
+		return "", false
+	}
+	cc, ok := b.Succs[0].Stmt.(*ast.CaseClause)
+	if !ok {
+		return "", false
+	}
+	ts, ok := l.typeSwitches[cc]
+	if !ok {
+		return "", false
+	}
+
+	subject, _ := typeSwitchSubject(ts)
+	var types []string
+	for _, t := range cc.List {
+		types = append(types, printRawNode(l.fset, t))
+	}
+	return fmt.Sprintf("%s is %s?", printRawNode(l.fset, subject), withArticle(strings.Join(types, " or "))), true
+}
+
+// isSwitchDefault reports whether b is where a switch lands once every
+// case has failed to match and a default clause exists. For expression
+// switches that's an empty jump into the default body; type switches
+// place the default statements in that block directly.
+func (l *labeler) isSwitchDefault(b *cfg.Block) bool {
+	if b.Kind != cfg.KindSwitchNextCase || len(b.Succs) != 1 {
+		return false
+	}
+
+	if ts, ok := l.typeSwitches[b.Stmt]; ok {
+		for _, stmt := range ts.Body.List {
+			if stmt.(*ast.CaseClause).List == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	body := b.Succs[0]
+	if len(b.Nodes) != 0 || body.Kind != cfg.KindSwitchCaseBody {
+		return false
+	}
+	cc, ok := body.Stmt.(*ast.CaseClause)
+	return ok && cc.List == nil
+}
+
+func withArticle(noun string) string {
+	if noun == "nil" {
+		return noun
+	}
+	first := strings.TrimLeft(noun, "*[]")
+	if first != "" && strings.ContainsRune("aeiouAEIOU", rune(first[0])) {
+		return "an " + noun
+	}
+	return "a " + noun
+}
+
+func (l *labeler) formatNodes(nodes []ast.Node, isCond bool) string {
+	defer l.redact.hide(l.body)()
+	var lines []string
+	shown, more := nodes, 0
+	if l.compact && len(nodes) > 1 {
+		shown, more = nodes[len(nodes)-1:], len(nodes)-1
+	}
+	for _, n := range shown {
+		s := l.phrase(n, isCond)
+		if more > 0 {
+			s += fmt.Sprintf(" (+%d more)", more)
+		}
+
+		s = wrapText(truncateLabel(s, l.maxLabel), 35)
+
+		lines = append(lines, strings.TrimSpace(s))
+	}
+	if l.lines && len(nodes) > 0 {
+		return l.lineRange(nodes) + strings.Join(lines, "\n\n")
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+// phrase puts n into words for a label on one line, with selector chains
+// shortened as -shorten asks.
+func (l *labeler) phrase(n ast.Node, isCond bool) string {
+	s := l.toNaturalLanguage(n, isCond)
+	if l.shorten > 0 {
+		s = shortenChains(s, l.shorten)
+	}
+	s = strings.ReplaceAll(s, "\n", " ")
+	return strings.ReplaceAll(s, "\t", "")
+}
+
+// loopLabel heads a counted for loop with its condition, as "Loop while i
+// is less than n". The whole phrase is truncated and follows the line
+// range, like any other label.
+func (l *labeler) loopLabel(cond ast.Expr) string {
+	defer l.redact.hide(l.body)()
+	s := "Loop while " + strings.TrimSuffix(l.phrase(cond, true), "?")
+	s = strings.TrimSpace(wrapText(truncateLabel(s, l.maxLabel), 35))
+	if l.lines {
+		return l.lineRange([]ast.Node{cond}) + s
+	}
+	return s
+}
+
+// addComments collects the comments ast.CommentMap attaches to
+// statements in body, whether on the line above or trailing on the same
+// line, keyed by the node the CFG will hold: an if, for or switch
+// statement's comment goes to its condition or tag.
+func (l *labeler) addComments(file *ast.File, body *ast.BlockStmt) {
+	cmap := ast.NewCommentMap(l.fset, file, file.Comments)
+	l.comments = make(map[ast.Node]string)
+	ast.Inspect(body, func(n ast.Node) bool {
+		if _, ok := n.(ast.Stmt); !ok || n == body {
+			return true
+		}
+		var texts []string
+		for _, cg := range cmap[n] {
+			texts = append(texts, strings.Join(strings.Fields(cg.Text()), " "))
+		}
+		if len(texts) == 0 {
+			return true
+		}
+		key := n
+		switch x := n.(type) {
+		case *ast.IfStmt:
+			key = x.Cond
+		case *ast.ForStmt:
+			if x.Cond != nil {
+				key = x.Cond
+			}
+		case *ast.SwitchStmt:
+			if x.Tag != nil {
+				key = x.Tag
+			}
+		case *ast.TypeSwitchStmt:
+			key = x.Assign
+		case *ast.LabeledStmt:
+			key = x.Stmt
+		}
+		l.comments[key] = strings.Join(texts, " ")
+		return true
+	})
+}
+
+// source prints nodes as written, one per line. A range statement stands
+// for the loop header only, so its body is left out.
+func (l *labeler) source(nodes []ast.Node) string {
+	defer l.redact.hide(l.body)()
+	var lines []string
+	for _, n := range nodes {
+		if r, ok := n.(*ast.RangeStmt); ok {
+			header := *r
+			header.Body = &ast.BlockStmt{}
+			lines = append(lines, strings.TrimSuffix(printRawNode(l.fset, &header), " {\n}"))
+			continue
+		}
+		lines = append(lines, printRawNode(l.fset, n))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notes returns the comments attached to nodes, one per line.
+func (l *labeler) notes(nodes []ast.Node) string {
+	var lines []string
+	for _, n := range nodes {
+		if c, ok := l.comments[n]; ok {
+			lines = append(lines, wrapText(truncateLabel(c, l.maxLabel), 35))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lineRange returns the "[12-18] " prefix -lines puts before a block's
+// label, spanning its first to last node. A range loop header covers its
+// clause only, not the whole loop body.
+func (l *labeler) lineRange(nodes []ast.Node) string {
+	n := nodes[len(nodes)-1]
+	end := n.End()
+	if r, ok := n.(*ast.RangeStmt); ok {
+		end = r.X.End()
+	}
+	first, last := l.fset.Position(nodes[0].Pos()).Line, l.fset.Position(end).Line
+	if first == last {
+		return fmt.Sprintf("[%d] ", first)
+	}
+	return fmt.Sprintf("[%d-%d] ", first, last)
+}
+
+// truncateLabel shortens s to at most limit characters, ending in "…". It
+// cuts at the last space or operator before the limit so identifiers stay
+// whole. A limit of zero or less leaves s alone.
+func truncateLabel(s string, limit int) string {
+	r := []rune(s)
+	if limit <= 0 || len(r) <= limit {
+		return s
+	}
+	cut := limit - 1
+	for i := cut; i > 0; i-- {
+		if strings.ContainsRune(" .,:;()[]{}+-*/%&|^!=<>", r[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRight(string(r[:cut]), " ") + "…"
+}
+
+var (
+	selectorChain = regexp.MustCompile(`[\p{L}_][\p{L}\p{N}_]*(?:\.[\p{L}_][\p{L}\p{N}_]*)+`)
+	stringLiteral = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`")
+)
+
+// shortenChains cuts selector chains in s longer than keep names down to
+// their last keep, e.g. s.store.users.FindByID(id) becomes …FindByID(id)
+// with keep 1. String literals are left alone.
+func shortenChains(s string, keep int) string {
+	shorten := func(text string) string {
+		var b strings.Builder
+		last := 0
+		for _, m := range selectorChain.FindAllStringIndex(text, -1) {
+			if m[0] > 0 && text[m[0]-1] == '.' {
+				continue
+			}
+			names := strings.Split(text[m[0]:m[1]], ".")
+			if len(names) <= keep {
+				continue
+			}
+			b.WriteString(text[last:m[0]])
+			b.WriteString("…" + strings.Join(names[len(names)-keep:], "."))
+			last = m[1]
+		}
+		b.WriteString(text[last:])
+		return b.String()
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range stringLiteral.FindAllStringIndex(s, -1) {
+		b.WriteString(shorten(s[last:m[0]]))
+		b.WriteString(s[m[0]:m[1]])
+		last = m[1]
+	}
+	b.WriteString(shorten(s[last:]))
+	return b.String()
+}
+
+// wrapText breaks text between words into lines of at most limit
+// characters, counting runes so non-ASCII text isn't wrapped early.
+func wrapText(text string, limit int) string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return ""
+	}
+
+	var result string
+	lineLen := 0
+
+	for i, word := range words {
+		n := utf8.RuneCountInString(word)
+		if i > 0 {
+			if lineLen+n > limit {
+				result += "\n"
+				lineLen = 0
+			} else {
+				result += " "
+				lineLen++
+			}
+		}
+		result += word
+		lineLen += n
+	}
+	return result
+}
+
+// syncPhrases describe the sync.Mutex, sync.RWMutex and sync.WaitGroup
+// methods -sync-hints recognizes, by receiver type and method.
+var syncPhrases = map[string]string{
+	"Mutex.Lock":      "🔒 Acquire lock %s",
+	"Mutex.Unlock":    "🔓 Release lock %s",
+	"RWMutex.Lock":    "🔒 Acquire lock %s",
+	"RWMutex.Unlock":  "🔓 Release lock %s",
+	"RWMutex.RLock":   "🔒 Acquire read lock %s",
+	"RWMutex.RUnlock": "🔓 Release read lock %s",
+	"WaitGroup.Add":   "➕ Add %[2]s to wait group %[1]s",
+	"WaitGroup.Done":  "✅ Mark wait group %s done",
+	"WaitGroup.Wait":  "⏳ Wait for wait group %s",
+}
+
+// syncHint phrases a call locking or unlocking a mutex or counting on a
+// wait group, so critical sections and waits stand out from other calls.
+// The method is resolved through types, which also catches mutexes
+// embedded in a struct. Anything else gives "".
+func (l *labeler) syncHint(e ast.Expr) string {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || l.syncInfo == nil {
+		return ""
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	fn := calleeOf(call, l.syncInfo)
+	if fn == nil || fn.Pkg() == nil || fn.Pkg().Path() != "sync" {
+		return ""
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return ""
+	}
+	t := recv.Type()
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return ""
+	}
+	format, ok := syncPhrases[named.Obj().Name()+"."+fn.Name()]
+	if !ok {
+		return ""
+	}
+	subject := printRawNode(l.fset, sel.X)
+	if len(call.Args) == 1 {
+		return fmt.Sprintf(format, subject, printRawNode(l.fset, call.Args[0]))
+	}
+	return fmt.Sprintf(format, subject)
+}
+
+// operand prints e for a comparison. With -resolve-consts, a named
+// constant is followed by its value, e.g. "StatusActive (2)", so values
+// hidden behind iota read plainly, including inside && and || chains.
+func (l *labeler) operand(e ast.Expr) string {
+	s := printRawNode(l.fset, e)
+	if l.consts == nil {
+		return s
+	}
+	var id *ast.Ident
+	switch x := e.(type) {
+	case *ast.Ident:
+		id = x
+	case *ast.SelectorExpr:
+		id = x.Sel
+	case *ast.ParenExpr:
+		return "(" + l.operand(x.X) + ")"
+	case *ast.BinaryExpr:
+		if _, ok := comparisonPhrases[x.Op]; ok {
+			return fmt.Sprintf("%s %s %s", l.operand(x.X), x.Op, l.operand(x.Y))
+		}
+	}
+	if id == nil {
+		return s
+	}
+	c, ok := l.consts.Uses[id].(*types.Const)
+	if !ok || c.Pkg() == nil {
+		return s
+	}
+	if tv, ok := l.consts.Types[e]; ok && tv.Value != nil {
+		return fmt.Sprintf("%s (%s)", s, tv.Value.ExactString())
+	}
+	return s
+}
+
+func (l *labeler) toNaturalLanguage(n ast.Node, isCond bool) string {
+	fset := l.fset
+
+	if sw, ok := l.switches[n]; ok && sw.Tag != nil {
+		tag := printRawNode(fset, sw.Tag)
+		if n == sw.Tag {
+			return fmt.Sprintf("Switch on %s", tag)
+		}
+		result := fmt.Sprintf("%s is %s", tag, printRawNode(fset, n))
+		if e, ok := n.(ast.Expr); ok {
+			result = fmt.Sprintf("%s is %s", tag, l.operand(e))
+		}
+		if isCond {
+			result += "?"
+		}
+		return result
+	}
+
+	if ts, ok := l.typeSwitches[n]; ok {
+		subject, bound := typeSwitchSubject(ts)
+		result := fmt.Sprintf("Switch on type of %s", printRawNode(fset, subject))
+		if bound != nil {
+			result += fmt.Sprintf(" as %s", bound.Name)
+		}
+		return result
+	}
+
+	if subject, _, ok := l.errorCheck(n); ok && isCond {
+		return "Check " + subject
+	}
+
+	var result string
+
+	switch x := n.(type) {
+	case *ast.UnaryExpr:
+		if x.Op == token.NOT {
+			result = negation(fset, x.X)
+		}
+	case *ast.BinaryExpr:
+		left := l.operand(x.X)
+		right := l.operand(x.Y)
+		if format, ok := comparisonPhrases[x.Op]; ok {
+			result = fmt.Sprintf(format, left, right)
+		}
+	case *ast.SendStmt:
+		result = l.describeChannelOp(x)
+	case *ast.AssignStmt:
+		if isReceive(x.Rhs[0]) && len(x.Rhs) == 1 && (x.Tok == token.ASSIGN || x.Tok == token.DEFINE) {
+			result = l.describeChannelOp(x)
+		} else if multi := describeMultiAssign(fset, x); multi != "" {
+			result = multi
+		} else if len(x.Lhs) == 1 && len(x.Rhs) == 1 {
+			left := printRawNode(fset, x.Lhs[0])
+			right := printRawNode(fset, x.Rhs[0])
+			switch x.Tok {
+			case token.ASSIGN, token.DEFINE:
+				result = fmt.Sprintf("Set %s to %s", left, right)
+				if lit := describeLiteral(fset, x.Rhs[0]); lit != "" {
+					result = fmt.Sprintf("Initialize %s (%s)", left, lit)
+				} else if fn, ok := x.Rhs[0].(*ast.FuncLit); ok {
+					result = fmt.Sprintf("Define %s as %s", left, describeFuncLit(fset, fn))
+				}
+			case token.ADD_ASSIGN:
+				result = fmt.Sprintf("Increase %s by %s", left, right)
+			case token.SUB_ASSIGN:
+				result = fmt.Sprintf("Decrease %s by %s", left, right)
+			case token.MUL_ASSIGN:
+				result = fmt.Sprintf("Multiply %s by %s", left, right)
+			case token.QUO_ASSIGN:
+				result = fmt.Sprintf("Divide %s by %s", left, right)
+			case token.REM_ASSIGN:
+				result = fmt.Sprintf("Reduce %s modulo %s", left, right)
+			case token.AND_ASSIGN:
+				result = fmt.Sprintf("Mask %s with %s", left, right)
+			case token.OR_ASSIGN:
+				result = fmt.Sprintf("Set bits %s in %s", right, left)
+			case token.XOR_ASSIGN:
+				result = fmt.Sprintf("Toggle bits %s in %s", right, left)
+			case token.AND_NOT_ASSIGN:
+				result = fmt.Sprintf("Clear bits %s in %s", right, left)
+			case token.SHL_ASSIGN:
+				result = fmt.Sprintf("Shift %s left by %s", left, right)
+			case token.SHR_ASSIGN:
+				result = fmt.Sprintf("Shift %s right by %s", left, right)
+			}
+		}
+	case *ast.ValueSpec:
+		if len(x.Names) == 1 && len(x.Values) == 1 {
+			result = fmt.Sprintf("Set %s to %s", x.Names[0].Name, printRawNode(fset, x.Values[0]))
+			if lit := describeLiteral(fset, x.Values[0]); lit != "" {
+				result = fmt.Sprintf("Initialize %s (%s)", x.Names[0].Name, lit)
+			} else if fn, ok := x.Values[0].(*ast.FuncLit); ok {
+				result = fmt.Sprintf("Define %s as %s", x.Names[0].Name, describeFuncLit(fset, fn))
+			}
+		} else if len(x.Values) == 0 && x.Type != nil {
+			var names []string
+			for _, name := range x.Names {
+				names = append(names, name.Name)
+			}
+			result = fmt.Sprintf("Declare %s as %s", strings.Join(names, ", "), printRawNode(fset, x.Type))
+		}
+	case *ast.GoStmt:
+		result = "Start goroutine: " + goroutineCall(fset, x)
+	case *ast.RangeStmt:
+		result = describeRange(fset, x)
+	case *ast.IncDecStmt:
+		val := printRawNode(fset, x.X)
+		if x.Tok == token.INC {
+			result = fmt.Sprintf("Increase %s by 1", val)
+		} else if x.Tok == token.DEC {
+			result = fmt.Sprintf("Decrease %s by 1", val)
+		}
+	case *ast.ReturnStmt:
+		if len(x.Results) > 0 {
+			var res []string
+			for _, r := range x.Results {
+				res = append(res, printRawNode(fset, r))
+			}
+			result = "Return " + strings.Join(res, ", ")
+		} else {
+			result = "Return"
+		}
+	case *ast.DeferStmt:
+		if hint := l.syncHint(x.Call); hint != "" {
+			result = hint + " on return"
+		}
+	case *ast.ExprStmt:
+		if hint := l.syncHint(x.X); hint != "" {
+			result = hint
+		} else if isReceive(x.X) {
+			result = l.describeChannelOp(x)
+		} else if call, ok := x.X.(*ast.CallExpr); ok {
+			if len(call.Args) == 1 && isBuiltinCall(call, "panic", nil) {
+				result = fmt.Sprintf("Panic with %s", printRawNode(fset, call.Args[0]))
+			} else if len(call.Args) > maxInlineArgs {
+				result = describeCall(fset, call)
+			}
+		}
+	case *ast.SelectorExpr, *ast.Ident:
+		if isCond {
+			result = fmt.Sprintf("Is %s?", printRawNode(fset, x))
+		}
+	}
+
+	if result == "" {
+		result = printRawNode(fset, n)
+	}
+
+	if isCond && !strings.HasSuffix(result, "?") {
+		result += "?"
+	}
+	return result
+}
+
+// describeMultiAssign phrases assignments of several values at once: a
+// comma-ok map lookup, a swap, or a parallel assignment. Anything else
+// gives "".
+func describeMultiAssign(fset *token.FileSet, a *ast.AssignStmt) string {
+	if a.Tok != token.ASSIGN && a.Tok != token.DEFINE {
+		return ""
+	}
+	if len(a.Lhs) == 2 && len(a.Rhs) == 1 {
+		// Only a map index yields a second, comma-ok value.
+		if idx, ok := ast.Unparen(a.Rhs[0]).(*ast.IndexExpr); ok {
+			return fmt.Sprintf("Look up %s in %s", printRawNode(fset, idx.Index), printRawNode(fset, idx.X))
+		}
+		return ""
+	}
+	if len(a.Lhs) < 2 || len(a.Lhs) != len(a.Rhs) {
+		return ""
+	}
+	var left, right []string
+	for i := range a.Lhs {
+		left = append(left, printRawNode(fset, a.Lhs[i]))
+		right = append(right, printRawNode(fset, a.Rhs[i]))
+	}
+	if len(left) == 2 && left[0] == right[1] && left[1] == right[0] {
+		return fmt.Sprintf("Swap %s and %s", left[0], left[1])
+	}
+	return fmt.Sprintf("Set %s to %s", strings.Join(left, ", "), strings.Join(right, ", "))
+}
+
+// negatedPredicates phrase the negation of well-known standard library
+// predicates, keyed by package and function name.
+var negatedPredicates = map[string]string{
+	"strings.HasPrefix": "%s does not have prefix %s",
+	"strings.HasSuffix": "%s does not have suffix %s",
+	"strings.Contains":  "%s does not contain %s",
+	"strings.EqualFold": "%s does not equal %s ignoring case",
+	"bytes.HasPrefix":   "%s does not have prefix %s",
+	"bytes.HasSuffix":   "%s does not have suffix %s",
+	"bytes.Contains":    "%s does not contain %s",
+	"bytes.Equal":       "%s does not equal %s",
+	"errors.Is":         "%s is not %s",
+}
+
+// comparisonPhrases read binary conditions aloud, left operand first.
+var comparisonPhrases = map[token.Token]string{
+	token.EQL:  "%s equals %s",
+	token.NEQ:  "%s does not equal %s",
+	token.LSS:  "%s is less than %s",
+	token.GTR:  "%s is greater than %s",
+	token.LEQ:  "%s is at most %s",
+	token.GEQ:  "%s is at least %s",
+	token.LAND: "%s AND %s",
+	token.LOR:  "%s OR %s",
+}
+
+// negatedComparisons maps a comparison onto the operator that holds when it
+// does not.
+var negatedComparisons = map[token.Token]token.Token{
+	token.EQL: token.NEQ,
+	token.NEQ: token.EQL,
+	token.LSS: token.GEQ,
+	token.GEQ: token.LSS,
+	token.GTR: token.LEQ,
+	token.LEQ: token.GTR,
+}
+
+// negation phrases !e. Plain values read as "x is false", recognized
+// predicates and comparisons are inverted, and && or || over plain values
+// is rewritten by De Morgan's laws. Anything else falls back to "NOT (e)".
+func negation(fset *token.FileSet, e ast.Expr) string {
+	switch x := e.(type) {
+	case *ast.ParenExpr:
+		return negation(fset, x.X)
+	case *ast.Ident, *ast.SelectorExpr, *ast.IndexExpr:
+		return fmt.Sprintf("%s is false", printRawNode(fset, x))
+	case *ast.CallExpr:
+		if sel, ok := x.Fun.(*ast.SelectorExpr); ok && len(x.Args) == 2 {
+			if pkg, ok := sel.X.(*ast.Ident); ok {
+				if format, ok := negatedPredicates[pkg.Name+"."+sel.Sel.Name]; ok {
+					return fmt.Sprintf(format, printRawNode(fset, x.Args[0]), printRawNode(fset, x.Args[1]))
+				}
+			}
+		}
+		return fmt.Sprintf("%s is false", printRawNode(fset, x))
+	case *ast.BinaryExpr:
+		left, right := printRawNode(fset, x.X), printRawNode(fset, x.Y)
+		if op, ok := negatedComparisons[x.Op]; ok {
+			return fmt.Sprintf(comparisonPhrases[op], left, right)
+		}
+		if x.Op == token.LAND || x.Op == token.LOR {
+			if isPlainValue(x.X) && isPlainValue(x.Y) {
+				dual := token.LOR
+				if x.Op == token.LOR {
+					dual = token.LAND
+				}
+				return fmt.Sprintf(comparisonPhrases[dual], negation(fset, x.X), negation(fset, x.Y))
+			}
+			return "not (" + fmt.Sprintf(comparisonPhrases[x.Op], left, right) + ")"
+		}
+	}
+	return fmt.Sprintf("NOT (%s)", printRawNode(fset, e))
+}
+
+// isPlainValue reports whether e is a name or field that negation can
+// phrase as "is false" without reordering anything.
+func isPlainValue(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.SelectorExpr:
+		return isPlainValue(x.X)
+	}
+	return false
+}
+
+// errorCheck recognizes an error compared against nil when errChecks is
+// on, returning the error expression and whether the condition holds when
+// it is set (!=) rather than when it is nil (==).
+func (l *labeler) errorCheck(n ast.Node) (subject string, failed, ok bool) {
+	bin, isBin := n.(*ast.BinaryExpr)
+	if !l.errChecks || !isBin || (bin.Op != token.NEQ && bin.Op != token.EQL) {
+		return "", false, false
+	}
+	x, y := bin.X, bin.Y
+	if isNilIdent(x) {
+		x, y = y, x
+	}
+	if !isNilIdent(y) || !l.isError(x) {
+		return "", false, false
+	}
+	return printRawNode(l.fset, x), bin.Op == token.NEQ, true
+}
+
+func (l *labeler) isError(e ast.Expr) bool {
+	if l.errInfo != nil {
+		if t := l.errInfo.TypeOf(e); t != nil {
+			return types.Identical(t, types.Universe.Lookup("error").Type())
+		}
+	}
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "err"
+}
+
+func isNilIdent(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "nil"
+}
+
+// describeFuncLit stands in for a function literal's body, which would
+// swamp the label: "anonymous function (12 lines)".
+func describeFuncLit(fset *token.FileSet, fn *ast.FuncLit) string {
+	lines := fset.Position(fn.End()).Line - fset.Position(fn.Pos()).Line + 1
+	if lines == 1 {
+		return "anonymous function (1 line)"
+	}
+	return fmt.Sprintf("anonymous function (%d lines)", lines)
+}
+
+// describeLiteral names a composite literal with elements, or a pointer to
+// one, by its type: "Config literal", "&Config literal". Anything else,
+// including an empty literal, which prints short anyway, gives "".
+func describeLiteral(fset *token.FileSet, e ast.Expr) string {
+	amp := ""
+	if u, ok := e.(*ast.UnaryExpr); ok && u.Op == token.AND {
+		amp, e = "&", u.X
+	}
+	lit, ok := e.(*ast.CompositeLit)
+	if !ok || len(lit.Elts) == 0 || lit.Type == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s%s literal", amp, printRawNode(fset, lit.Type))
+}
+
+// goroutineCall prints the call a go statement starts, shortening a
+// function literal's body to "{ … }".
+func goroutineCall(fset *token.FileSet, g *ast.GoStmt) string {
+	if lit, ok := ast.Unparen(g.Call.Fun).(*ast.FuncLit); ok {
+		var args []string
+		for _, a := range g.Call.Args {
+			args = append(args, printRawNode(fset, a))
+		}
+		return fmt.Sprintf("%s { … }(%s)", printRawNode(fset, lit.Type), strings.Join(args, ", "))
+	}
+	return printRawNode(fset, g.Call)
+}
+
+// maxInlineArgs is the most arguments a call statement may have before
+// its label summarizes it instead of printing every argument.
+const maxInlineArgs = 3
+
+// describeCall summarizes a call with many arguments as "Call f with N
+// args", naming f by the identifier or selector it is called through.
+func describeCall(fset *token.FileSet, call *ast.CallExpr) string {
+	fun := ast.Unparen(call.Fun)
+	switch f := fun.(type) {
+	case *ast.IndexExpr:
+		fun = f.X
+	case *ast.IndexListExpr:
+		fun = f.X
+	}
+	switch fun.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		return fmt.Sprintf("Call %s with %d args", printRawNode(fset, fun), len(call.Args))
+	}
+	return printRawNode(fset, call)
+}
+
+// describeRange phrases a range loop header, dropping blank identifiers:
+// "For each k, v in m", "For each v in items", "For each element in ch".
+func describeRange(fset *token.FileSet, r *ast.RangeStmt) string {
+	var vars []string
+	for _, e := range []ast.Expr{r.Key, r.Value} {
+		if id, ok := e.(*ast.Ident); e == nil || (ok && id.Name == "_") {
+			continue
+		}
+		vars = append(vars, printRawNode(fset, e))
+	}
+
+	subject := "element"
+	if len(vars) > 0 {
+		subject = strings.Join(vars, ", ")
+	}
+	return fmt.Sprintf("For each %s in %s", subject, printRawNode(fset, r.X))
+}
+
+// printRawNode prints n as Go source. Should the printer fail, as it can
+// on a malformed node, the label says so in place of the source rather
+// than coming out blank or cut short.
+func printRawNode(fset *token.FileSet, n ast.Node) string {
+	var b bytes.Buffer
+	if err := printer.Fprint(&b, fset, n); err != nil {
+		return fmt.Sprintf("<unprintable %T: %v>", n, err)
+	}
+	return b.String()
+}
+
+// noiseFilter decides which call receivers count as telemetry noise.
+// -exclude replaces the default name list, -ignore extends it, and
+// -ignore-regex matches on top of both.
+type noiseFilter struct {
+	names   map[string]bool
+	pattern *regexp.Regexp
+}
+
+func newNoiseFilter(opts Options) (*noiseFilter, error) {
+	f := &noiseFilter{names: make(map[string]bool)}
+	for _, list := range []string{opts.Exclude, opts.Ignore} {
+		for _, item := range strings.Split(list, ",") {
+			trimmed := strings.TrimSpace(item)
+			if trimmed != "" {
+				f.names[trimmed] = true
+			}
+		}
+	}
+
+	if opts.IgnoreRegex != "" {
+		re, err := regexp.Compile(opts.IgnoreRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -ignore-regex: %v", err)
+		}
+		f.pattern = re
+	}
+	return f, nil
+}
+
+func (f *noiseFilter) matches(name string) bool {
+	return f.names[name] || (f.pattern != nil && f.pattern.MatchString(name))
+}
+
+// telemetryPackages are import paths whose values are noise whatever they
+// are called. Subpackages count too.
+var telemetryPackages = []string{
+	"log",
+	"log/slog",
+	"go.uber.org/zap",
+	"github.com/sirupsen/logrus",
+	"github.com/rs/zerolog",
+	"github.com/go-kit/log",
+	"github.com/go-logr/logr",
+	"k8s.io/klog",
+	"go.opentelemetry.io/otel",
+	"github.com/opentracing/opentracing-go",
+	"github.com/prometheus/client_golang",
+}
+
+// matchesPackage reports whether values from pkg are noise: it is a known
+// logging, tracing or metrics package, or its name is on the filter list.
+func (f *noiseFilter) matchesPackage(pkg *types.Package) bool {
+	if pkg == nil {
+		return false
+	}
+	for _, path := range telemetryPackages {
+		if pkg.Path() == path || strings.HasPrefix(pkg.Path(), path+"/") {
+			return true
+		}
+	}
+	return f.matches(pkg.Name())
+}
+
+// matchesIdent decides whether a receiver or variable is noise. A package
+// goes by its import path. A variable is noise if its type comes from a
+// noise package or its name is on the list, unless the name merely looks
+// like a logging package's: a domain variable called log, typed by some
+// other package, is kept. Without type information the identifier's name
+// is all there is.
+func (f *noiseFilter) matchesIdent(ident *ast.Ident, info *types.Info) bool {
+	if info != nil {
+		switch obj := info.ObjectOf(ident).(type) {
+		case *types.PkgName:
+			return f.matchesPackage(obj.Imported())
+		case *types.Var:
+			if pkg := typePackage(obj.Type()); pkg != nil {
+				if f.matchesPackage(pkg) {
+					return true
+				}
+				if isTelemetryName(ident.Name) {
+					return false
+				}
+			}
+		}
+	}
+	return f.matches(ident.Name)
+}
+
+// isTelemetryName reports whether name is spelled like one of the
+// telemetryPackages, as a variable shadowing the log package would be.
+func isTelemetryName(name string) bool {
+	for _, p := range telemetryPackages {
+		if path.Base(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typePackage returns the package that declares t, looking through
+// pointers; built-in and unnamed types have none.
+func typePackage(t types.Type) *types.Package {
+	t = types.Unalias(t)
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = types.Unalias(ptr.Elem())
+	}
+	if named, ok := t.(*types.Named); ok {
+		return named.Obj().Pkg()
+	}
+	return nil
+}
+
+func filterNoise(nodes []ast.Node, noise *noiseFilter, info *types.Info) (keep, removed []ast.Node) {
+	for _, n := range nodes {
+		isNoise := false
+
+		switch x := n.(type) {
+		case *ast.ExprStmt:
+			isNoise = isNoiseCall(x.X, noise, info)
+		case *ast.AssignStmt:
+			isNoise = isNoiseAssign(x, noise, info)
+		case *ast.DeferStmt:
+			isNoise = isNoiseCall(x.Call, noise, info)
+		}
+
+		if isNoise {
+			removed = append(removed, n)
+		} else {
+			keep = append(keep, n)
+		}
+	}
+	return keep, removed
+}
+
+func isNoiseCall(expr ast.Expr, noise *noiseFilter, info *types.Info) bool {
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				return noise.matchesIdent(ident, info)
+			}
+		}
+	}
+	return false
+}
+
+// isNoiseAssign reports whether every value assigned comes from a noise
+// call, or a call hands back a noise variable, as in
+// ctx, span := tracer.Start(ctx, "op").
+func isNoiseAssign(a *ast.AssignStmt, noise *noiseFilter, info *types.Info) bool {
+	if len(a.Rhs) == 0 {
+		return false
+	}
+
+	allNoise := true
+	for _, rhs := range a.Rhs {
+		if !isNoiseCall(rhs, noise, info) {
+			allNoise = false
+			break
+		}
+	}
+	if allNoise {
+		return true
+	}
+
+	if _, ok := a.Rhs[0].(*ast.CallExpr); ok && len(a.Rhs) == 1 {
+		for _, lhs := range a.Lhs {
+			if ident, ok := lhs.(*ast.Ident); ok && ident.Name != "_" && noise.matchesIdent(ident, info) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isErrorReturn(nodes []ast.Node, fset *token.FileSet) bool {
+	for _, n := range nodes {
+		if ret, ok := n.(*ast.ReturnStmt); ok {
+			for _, res := range ret.Results {
+				text := printRawNode(fset, res)
+				if text == "err" || strings.HasPrefix(text, "Err") || strings.Contains(text, ".Err()") || strings.Contains(text, "Error") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// pruneReturns adds a shared End block to g and points every reachable
+// block without successors at it, except those ending in a panic. The
+// returns themselves are removed, and blocks that held nothing else are
+// routed around, unless they are a switch or select case: those stay, as
+// the case's edge is drawn from them.
+func pruneReturns(g *cfg.CFG, info *types.Info) *cfg.Block {
+	end := &cfg.Block{Index: int32(len(g.Blocks)), Kind: cfg.KindBody, Live: true}
+	emptied := make(map[*cfg.Block]bool)
+	for _, b := range g.Blocks {
+		if !b.Live || len(b.Succs) > 0 || endsInPanic(b, info) {
+			continue
+		}
+		if n := len(b.Nodes); n > 0 {
+			if _, ok := b.Nodes[n-1].(*ast.ReturnStmt); ok {
+				b.Nodes = b.Nodes[:n-1]
+			}
+		}
+		b.Succs = []*cfg.Block{end}
+		emptied[b] = len(b.Nodes) == 0
+	}
+	for _, b := range g.Blocks {
+		for i, succ := range b.Succs {
+			if emptied[succ] && !isCase(succ) {
+				b.Succs[i] = end
+			}
+		}
+	}
+	g.Blocks = append(g.Blocks, end)
+	return end
+}
+
+// isCase reports whether b belongs to a switch or select case rather than
+// following one.
+func isCase(b *cfg.Block) bool {
+	switch b.Kind {
+	case cfg.KindSelectCaseBody, cfg.KindSwitchCaseBody, cfg.KindSwitchNextCase:
+		return true
+	}
+	return false
+}
+
+// statementShape picks a block's shape from the kind of statement most of
+// its nodes are: calls, including assignments from one, are subroutines
+// and channel operations parallelograms. Assignments, and ties, keep the
+// plain box.
+func statementShape(nodes []ast.Node) shape {
+	var calls, channels, others int
+	for _, n := range nodes {
+		switch x := n.(type) {
+		case *ast.SendStmt:
+			channels++
+		case *ast.ExprStmt:
+			if isReceive(x.X) {
+				channels++
+			} else if _, ok := x.X.(*ast.CallExpr); ok {
+				calls++
+			} else {
+				others++
+			}
+		case *ast.AssignStmt:
+			if len(x.Rhs) == 1 && isReceive(x.Rhs[0]) {
+				channels++
+			} else if _, ok := x.Rhs[0].(*ast.CallExpr); ok && len(x.Rhs) == 1 {
+				calls++
+			} else {
+				others++
+			}
+		case *ast.DeferStmt, *ast.GoStmt:
+			calls++
+		default:
+			others++
+		}
+	}
+	if calls > channels && calls > others {
+		return shapeSubroutine
+	}
+	if channels > calls && channels > others {
+		return shapeParallelogram
+	}
+	return shapeBox
+}
+
+// reachableBlocks returns the blocks a walk along successors from entry
+// reaches, through both branches of every decision and around loops.
+func reachableBlocks(entry *cfg.Block) map[int32]bool {
+	reached := map[int32]bool{entry.Index: true}
+	queue := []*cfg.Block{entry}
+	for len(queue) > 0 {
+		b := queue[0]
+		queue = queue[1:]
+		for _, succ := range b.Succs {
+			if !reached[succ.Index] {
+				reached[succ.Index] = true
+				queue = append(queue, succ)
+			}
+		}
+	}
+	return reached
+}
+
+// countedLoop reports whether b is the condition of a three-clause for
+// loop, as in for i := 0; i < n; i++.
+func countedLoop(b *cfg.Block) (*ast.ForStmt, bool) {
+	s, ok := b.Stmt.(*ast.ForStmt)
+	if !ok || b.Kind != cfg.KindForLoop || s.Cond == nil || s.Post == nil {
+		return nil, false
+	}
+	return s, len(b.Succs) == 2 && len(b.Nodes) == 1 && b.Nodes[0] == s.Cond
+}
+
+// blockEdge identifies the edge from one block to another by index.
+type blockEdge struct{ From, To int32 }
+
+// foldForPosts points the edges into each counted loop's post block
+// straight at the loop's condition and returns the post statement's
+// source for each such edge, e.g. "i++". The post blocks are left with no
+// successors and nothing leads to them.
+func foldForPosts(blocks []*cfg.Block, fset *token.FileSet) map[blockEdge]string {
+	posts := make(map[*cfg.Block]string)
+	for _, b := range blocks {
+		if _, ok := countedLoop(b); !ok {
+			continue
+		}
+		loop := b.Stmt.(*ast.ForStmt)
+		for _, p := range blocks {
+			if p.Kind == cfg.KindForPost && p.Stmt == loop && len(p.Nodes) == 1 && len(p.Succs) == 1 && p.Succs[0] == b {
+				posts[p] = printRawNode(fset, loop.Post)
+			}
+		}
+	}
+
+	steps := make(map[blockEdge]string)
+	for _, b := range blocks {
+		for i, succ := range b.Succs {
+			if step, ok := posts[succ]; ok {
+				b.Succs[i] = succ.Succs[0]
+				steps[blockEdge{b.Index, b.Succs[i].Index}] = step
+			}
+		}
+	}
+	for p := range posts {
+		p.Succs = nil
+	}
+	return steps
+}
+
+// stepVia returns the folded post statement, if any, on the flow from b
+// into succ, following empty pass-through blocks the way jumpVia does.
+func stepVia(b, succ *cfg.Block, preds map[int32][]int32, steps map[blockEdge]string) string {
+	visited := make(map[int32]bool)
+	for prev, curr := b, succ; !visited[curr.Index]; prev, curr = curr, curr.Succs[0] {
+		if step, ok := steps[blockEdge{prev.Index, curr.Index}]; ok {
+			return step
+		}
+		visited[curr.Index] = true
+		if !isEmptyPassThrough(curr, preds) {
+			break
+		}
+	}
+	return ""
+}
+
+// cyclomatic computes McCabe's complexity, edges - nodes + 2, over the
+// reachable blocks. Every block without successors is given an edge to
+// one shared virtual exit, so functions with several returns count the
+// same as if they all funneled through a single one.
+func cyclomatic(g *cfg.CFG) int {
+	nodes, edges := 1, 0
+	for _, b := range g.Blocks {
+		if !b.Live {
+			continue
+		}
+		nodes++
+		edges += len(b.Succs)
+		if len(b.Succs) == 0 {
+			edges++
+		}
+	}
+	return edges - nodes + 2
+}
+
+// isEarlyReturn reports whether a block with no successors leaves the
+// function before its last statement, as a guard clause does. Returns
+// within the last statement, such as both arms of a final if/else, are
+// not early.
+func isEarlyReturn(block *cfg.Block, body *ast.BlockStmt) bool {
+	if len(block.Nodes) == 0 || len(body.List) == 0 {
+		return false
+	}
+	return block.Nodes[len(block.Nodes)-1].Pos() < body.List[len(body.List)-1].Pos()
+}
+
+// isBuiltinCall reports whether call invokes the named builtin. With type
+// information a function shadowing the builtin doesn't count; without it
+// the name alone decides.
+func isBuiltinCall(call *ast.CallExpr, name string, info *types.Info) bool {
+	id, ok := ast.Unparen(call.Fun).(*ast.Ident)
+	if !ok || id.Name != name {
+		return false
+	}
+	if info == nil {
+		return true
+	}
+	_, ok = info.Uses[id].(*types.Builtin)
+	return ok
+}
+
+// endsInPanic reports whether the block's flow stops at a call to panic.
+func endsInPanic(b *cfg.Block, info *types.Info) bool {
+	if len(b.Succs) != 0 || len(b.Nodes) == 0 {
+		return false
+	}
+	stmt, ok := b.Nodes[len(b.Nodes)-1].(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	call, ok := stmt.X.(*ast.CallExpr)
+	return ok && isBuiltinCall(call, "panic", info)
+}
+
+// deferredRecovers finds the defer statements in body that can stop a
+// panic: a deferred recover() itself, or a deferred function literal that
+// calls it.
+func deferredRecovers(body *ast.BlockStmt, info *types.Info) map[ast.Node]bool {
+	recovers := make(map[ast.Node]bool)
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.DeferStmt:
+			if isBuiltinCall(x.Call, "recover", info) {
+				recovers[x] = true
+			} else if lit, ok := x.Call.Fun.(*ast.FuncLit); ok {
+				ast.Inspect(lit.Body, func(m ast.Node) bool {
+					if call, ok := m.(*ast.CallExpr); ok && isBuiltinCall(call, "recover", info) {
+						recovers[x] = true
+					}
+					return !recovers[x]
+				})
+			}
+			return false
+		}
+		return true
+	})
+	return recovers
+}
+
+// recoverGuard finds the usual deferred recover: a function literal
+// whose body tests "if r := recover(); r != nil" or "if recover() != nil".
+// It returns the first such defer statement and its if statement, or nils.
+func recoverGuard(body *ast.BlockStmt, info *types.Info) (guardDefer *ast.DeferStmt, guard *ast.IfStmt) {
+	for n := range deferredRecovers(body, info) {
+		ds := n.(*ast.DeferStmt)
+		lit, ok := ds.Call.Fun.(*ast.FuncLit)
+		if !ok || (guardDefer != nil && guardDefer.Pos() < ds.Pos()) {
+			continue
+		}
+		for _, stmt := range lit.Body.List {
+			if ifs, ok := stmt.(*ast.IfStmt); ok && isRecoverTest(ifs, info) {
+				guardDefer, guard = ds, ifs
+				break
+			}
+		}
+	}
+	return guardDefer, guard
+}
+
+// isRecoverTest reports whether ifs compares recover()'s result, called
+// in the condition or assigned in the init, against nil.
+func isRecoverTest(ifs *ast.IfStmt, info *types.Info) bool {
+	bin, ok := ifs.Cond.(*ast.BinaryExpr)
+	if !ok || bin.Op != token.NEQ || !isNilIdent(bin.Y) {
+		return false
+	}
+	if call, ok := ast.Unparen(bin.X).(*ast.CallExpr); ok {
+		return isBuiltinCall(call, "recover", info)
+	}
+	assign, ok := ifs.Init.(*ast.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return false
+	}
+	lhs, ok := assign.Lhs[0].(*ast.Ident)
+	x, ok2 := bin.X.(*ast.Ident)
+	call, ok3 := assign.Rhs[0].(*ast.CallExpr)
+	return ok && ok2 && ok3 && lhs.Name == x.Name && isBuiltinCall(call, "recover", info)
+}
+
+// registeredIn returns the blocks by whose end ds may have been
+// registered, whether it is still among the block's nodes or was
+// extracted into byBlock.
+func registeredIn(blocks []*cfg.Block, ds *ast.DeferStmt, byBlock map[int32][]*ast.DeferStmt) map[int32]bool {
+	own := make(map[int32][]*ast.DeferStmt)
+	for _, b := range blocks {
+		for _, n := range b.Nodes {
+			if n == ast.Node(ds) {
+				own[b.Index] = []*ast.DeferStmt{ds}
+			}
+		}
+		for _, d := range byBlock[b.Index] {
+			if d == ds {
+				own[b.Index] = []*ast.DeferStmt{ds}
+			}
+		}
+	}
+	registered := make(map[int32]bool)
+	for index, pending := range pendingDefers(blocks, own) {
+		if len(pending) > 0 {
+			registered[index] = true
+		}
+	}
+	return registered
+}
+
+func containsAny(nodes []ast.Node, set map[ast.Node]bool) bool {
+	for _, n := range nodes {
+		if set[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingDefers returns, for every block, the defer statements that may
+// have been registered by the time it finishes, in the order they run:
+// last registered first. A defer counts once a path to the block passes
+// it, even if other paths don't.
+func pendingDefers(blocks []*cfg.Block, byBlock map[int32][]*ast.DeferStmt) map[int32][]*ast.DeferStmt {
+	pending := make(map[int32][]*ast.DeferStmt)
+	for _, b := range blocks {
+		pending[b.Index] = mergeDefers(nil, byBlock[b.Index])
+	}
+	// Sets only grow and are bounded by the defers there are, so this
+	// settles.
+	for changed := true; changed; {
+		changed = false
+		for _, b := range blocks {
+			for _, succ := range b.Succs {
+				merged := mergeDefers(pending[succ.Index], pending[b.Index])
+				if len(merged) != len(pending[succ.Index]) {
+					pending[succ.Index] = merged
+					changed = true
+				}
+			}
+		}
+	}
+	return pending
+}
+
+// mergeDefers returns the union of a and b, latest in the source first.
+func mergeDefers(a, b []*ast.DeferStmt) []*ast.DeferStmt {
+	seen := make(map[*ast.DeferStmt]bool)
+	var merged []*ast.DeferStmt
+	for _, ds := range append(append([]*ast.DeferStmt(nil), a...), b...) {
+		if !seen[ds] {
+			seen[ds] = true
+			merged = append(merged, ds)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Pos() > merged[j].Pos() })
+	return merged
+}
+
+// extractDefers removes defer statements from the blocks and returns the
+// reachable ones by the block that registers them.
+func extractDefers(blocks []*cfg.Block) map[int32][]*ast.DeferStmt {
+	defers := make(map[int32][]*ast.DeferStmt)
+	for _, b := range blocks {
+		var keep []ast.Node
+		for _, n := range b.Nodes {
+			if ds, ok := n.(*ast.DeferStmt); ok {
+				if b.Live {
+					defers[b.Index] = append(defers[b.Index], ds)
+				}
+				continue
+			}
+			keep = append(keep, n)
+		}
+		b.Nodes = keep
+	}
+	return defers
+}
+
+// stripRangeOperands removes the range expression and iteration variables
+// that cfg evaluates just before jumping into a range loop; the loop header
+// describes them instead.
+func stripRangeOperands(b *cfg.Block) {
+	if len(b.Succs) != 1 || b.Succs[0].Kind != cfg.KindRangeLoop {
+		return
+	}
+	r, ok := b.Succs[0].Stmt.(*ast.RangeStmt)
+	if !ok {
+		return
+	}
+
+	var keep []ast.Node
+	for _, n := range b.Nodes {
+		if n == r.X || (r.Key != nil && n == r.Key) || (r.Value != nil && n == r.Value) {
+			continue
+		}
+		keep = append(keep, n)
+	}
+	b.Nodes = keep
+}
+
+// foldTypeCases merges the chain of per-type tests cfg builds for a
+// multi-type case (case A, B:) into its first test, so the diagram shows a
+// single "x is A or B?" decision. It returns the blocks folded away.
+func foldTypeCases(blocks []*cfg.Block, lbl *labeler) map[int32]bool {
+	tests := make(map[*cfg.Block][]*cfg.Block) // case body -> its type tests, in index order
+	for _, b := range blocks {
+		if _, ok := lbl.typeCaseLabel(b); ok {
+			tests[b.Succs[0]] = append(tests[b.Succs[0]], b)
+		}
+	}
+
+	hidden := make(map[int32]bool)
+	for _, chain := range tests {
+		if len(chain) < 2 {
+			continue
+		}
+		first, last := chain[0], chain[len(chain)-1]
+		first.Succs[1] = last.Succs[1]
+		for _, b := range chain[1:] {
+			b.Succs = nil
+			hidden[b.Index] = true
+		}
+	}
+	return hidden
+}
+
+// backEdges finds the edges that close a cycle: walking depth-first from
+// the entry block, they lead back to a block still on the walk's stack.
+// Unlike comparing block indexes, this ignores forward gotos and switch
+// fallthroughs that land on a block created earlier.
+func backEdges(blocks []*cfg.Block) map[[2]int32]bool {
+	back := make(map[[2]int32]bool)
+	const onStack, done = 1, 2
+	state := make(map[int32]int)
+
+	var visit func(b *cfg.Block)
+	visit = func(b *cfg.Block) {
+		state[b.Index] = onStack
+		for _, succ := range b.Succs {
+			switch state[succ.Index] {
+			case 0:
+				visit(succ)
+			case onStack:
+				back[[2]int32{b.Index, succ.Index}] = true
+			}
+		}
+		state[b.Index] = done
+	}
+	for _, b := range blocks {
+		if state[b.Index] == 0 {
+			visit(b)
+		}
+	}
+	return back
+}
+
+// isBackEdge reports whether the flow from b into succ, followed through
+// any empty pass-through blocks, takes a back edge.
+func isBackEdge(b, succ *cfg.Block, preds map[int32][]int32, back map[[2]int32]bool) bool {
+	visited := make(map[int32]bool)
+	for from, curr := b, succ; ; from, curr = curr, curr.Succs[0] {
+		if back[[2]int32{from.Index, curr.Index}] {
+			return true
+		}
+		if !isEmptyPassThrough(curr, preds) || visited[curr.Index] {
+			return false
+		}
+		visited[curr.Index] = true
+	}
+}
+
+// branchBlocks maps each block that ends in a labeled break or continue,
+// or a goto, to that statement. cfg turns branch statements into edges
+// without keeping them as nodes, so each is traced back to its block
+// through the statement before it, or the body its list opens.
+func branchBlocks(body *ast.BlockStmt, blocks []*cfg.Block) map[int32]*ast.BranchStmt {
+	byNode := make(map[ast.Node]*cfg.Block)
+	type kindStmt struct {
+		kind cfg.BlockKind
+		stmt ast.Stmt
+	}
+	byKind := make(map[kindStmt]*cfg.Block)
+	for _, b := range blocks {
+		for _, n := range b.Nodes {
+			byNode[n] = b
+		}
+		if b.Stmt != nil {
+			byKind[kindStmt{b.Kind, b.Stmt}] = b
+		}
+	}
+
+	// after finds the block flow is in once stmt has run.
+	var after func(stmt ast.Stmt) *cfg.Block
+	after = func(stmt ast.Stmt) *cfg.Block {
+		switch s := stmt.(type) {
+		case *ast.IfStmt:
+			return byKind[kindStmt{cfg.KindIfDone, s}]
+		case *ast.ForStmt:
+			return byKind[kindStmt{cfg.KindForDone, s}]
+		case *ast.RangeStmt:
+			return byKind[kindStmt{cfg.KindRangeDone, s}]
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt:
+			return byKind[kindStmt{cfg.KindSwitchDone, s}]
+		case *ast.SelectStmt:
+			return byKind[kindStmt{cfg.KindSelectDone, s}]
+		case *ast.LabeledStmt:
+			return after(s.Stmt)
+		}
+		return byNode[stmt]
+	}
+
+	jumps := make(map[int32]*ast.BranchStmt)
+	scan := func(list []ast.Stmt, first *cfg.Block) {
+		for i, stmt := range list {
+			br, ok := stmt.(*ast.BranchStmt)
+			if !ok || (br.Tok != token.GOTO && br.Label == nil) {
+				continue
+			}
+			b := first
+			if i > 0 {
+				b = after(list[i-1])
+			}
+			if b != nil {
+				jumps[b.Index] = br
+			}
+		}
+	}
+
+	scan(body.List, blocks[0])
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt:
+			scan(s.Body.List, byKind[kindStmt{cfg.KindIfThen, s}])
+			if els, ok := s.Else.(*ast.BlockStmt); ok {
+				scan(els.List, byKind[kindStmt{cfg.KindIfElse, s}])
+			}
+		case *ast.ForStmt:
+			scan(s.Body.List, byKind[kindStmt{cfg.KindForBody, s}])
+		case *ast.RangeStmt:
+			scan(s.Body.List, byKind[kindStmt{cfg.KindRangeBody, s}])
+		case *ast.CaseClause:
+			scan(s.Body, byKind[kindStmt{cfg.KindSwitchCaseBody, s}])
+		case *ast.CommClause:
+			scan(s.Body, byKind[kindStmt{cfg.KindSelectCaseBody, s}])
+		}
+		return true
+	})
+	return jumps
+}
+
+// jumpVia describes the branch statement, if any, behind the flow from b
+// into succ: b's own jump, or one in an empty block passed through on
+// the way, e.g. "break outer" or "goto retry".
+func jumpVia(b, succ *cfg.Block, preds map[int32][]int32, jumps map[int32]*ast.BranchStmt) string {
+	br := jumps[b.Index]
+	if len(b.Succs) != 1 {
+		br = nil
+	}
+	visited := make(map[int32]bool)
+	for curr := succ; br == nil && isEmptyPassThrough(curr, preds) && !visited[curr.Index]; curr = curr.Succs[0] {
+		visited[curr.Index] = true
+		br = jumps[curr.Index]
+	}
+	if br == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", br.Tok, br.Label.Name)
+}
+
+func withJump(label, jump string) string {
+	if label == "" || jump == "" {
+		return label + jump
+	}
+	return label + ": " + jump
+}
+
+func getEntryPoint(b *cfg.Block, split map[int32]bool) string {
+	if split[b.Index] {
+		return fmt.Sprintf("B%d_setup", b.Index)
+	}
+	return fmt.Sprintf("B%d", b.Index)
+}
+
+// dumpBlocks writes one line per block of fn's graph, as the diagram is
+// about to be drawn from it: its statement count, successors, and how
+// the drawing treats it.
+func dumpBlocks(w io.Writer, fn string, blocks []*cfg.Block, preds map[int32][]int32, split, hidden, dead map[int32]bool) {
+	fmt.Fprintf(w, "Blocks of %s:\n", fn)
+	for _, b := range blocks {
+		var succs []string
+		for _, succ := range b.Succs {
+			succs = append(succs, fmt.Sprint(succ.Index))
+		}
+		var treated []string
+		switch {
+		case dead[b.Index]:
+			treated = append(treated, "dropped")
+		case hidden[b.Index]:
+			treated = append(treated, "hidden")
+		case isEmptyPassThrough(b, preds):
+			treated = append(treated, "pass-through")
+		case len(b.Succs) == 0:
+			treated = append(treated, "terminal")
+		}
+		if split[b.Index] {
+			treated = append(treated, "split")
+		}
+		if !b.Live {
+			treated = append(treated, "unreachable")
+		}
+		fmt.Fprintf(w, "  %s: %d nodes, succs [%s]", b, len(b.Nodes), strings.Join(succs, " "))
+		if len(treated) > 0 {
+			fmt.Fprintf(w, ", %s", strings.Join(treated, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func isEmptyPassThrough(b *cfg.Block, preds map[int32][]int32) bool {
+	if len(b.Nodes) == 0 && len(b.Succs) == 1 {
+		if len(preds[b.Index]) > 1 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// resolveDestination follows empty pass-through blocks from b to the block
+// that does something. A cycle of nothing but pass-throughs resolves to
+// the block where the cycle closes, so the edge lands on the loop itself
+// rather than wherever the walk stopped.
+func resolveDestination(b *cfg.Block, preds map[int32][]int32) *cfg.Block {
+	curr := b
+	visited := make(map[int32]bool)
+	for isEmptyPassThrough(curr, preds) {
+		if visited[curr.Index] {
+			return curr
+		}
+		visited[curr.Index] = true
+		curr = curr.Succs[0]
+	}
+	return curr
+}
+
+func getStructuralLabel(block *cfg.Block) string {
+	if block.Index == 0 {
+		return "Start"
+	}
+	if len(block.Succs) == 0 {
+		return "End / Return"
+	}
+	if len(block.Succs) == 2 {
+		return "Decision / Branch"
+	}
+	return "Merge Point"
+}
@@ -0,0 +1,671 @@
+package flowgen
+
+import (
+	"bytes"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/cfg"
+)
+
+// writeModule writes src as the main.go of a module of its own and
+// returns its directory.
+func writeModule(t *testing.T, src string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/fixture\n\ngo 1.21\n",
+		"main.go": src,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// mermaidOf draws opts.Start from src as Mermaid, with the default noise
+// filter unless opts says otherwise.
+func mermaidOf(t *testing.T, src string, opts Options) string {
+	t.Helper()
+	opts.Dir = writeModule(t, src)
+	if opts.Exclude == "" && !opts.NoFilter {
+		opts.Exclude = DefaultExclude
+	}
+	out, err := Generate(opts)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	return out
+}
+
+func TestTypeSwitch(t *testing.T) {
+	src := `package main
+
+func kind(v any) string {
+	switch v.(type) {
+	case int:
+		return "int"
+	case string:
+		return "string"
+	}
+	return "other"
+}
+
+func main() { kind(1) }
+`
+	for _, idiomatic := range []bool{false, true} {
+		out := mermaidOf(t, src, Options{Start: "kind", IdiomaticErrors: idiomatic})
+		for _, want := range []string{"Switch on type of v", "Return #quot;int#quot;", "Return #quot;other#quot;"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("IdiomaticErrors=%v: output lacks %q:\n%s", idiomatic, want, out)
+			}
+		}
+	}
+}
+
+func TestEmptyForLoop(t *testing.T) {
+	src := `package main
+
+func spin() {
+	for {
+	}
+}
+
+func spinAfter(n int) {
+	n++
+	for {
+	}
+}
+
+func main() { spin() }
+`
+	for _, start := range []string{"spin", "spinAfter"} {
+		out := mermaidOf(t, src, Options{Start: start})
+		m := regexp.MustCompile(`(\w+)\["Loop forever"\]`).FindStringSubmatch(out)
+		if m == nil {
+			t.Fatalf("%s: no Loop forever node:\n%s", start, out)
+		}
+		if self := m[1] + " -.-> " + m[1] + ";"; !strings.Contains(out, self) {
+			t.Errorf("%s: output lacks the back edge %q:\n%s", start, self, out)
+		}
+	}
+}
+
+func TestGoroutineBeforeCondition(t *testing.T) {
+	src := `package main
+
+func work() {}
+
+func start(ok bool) {
+	go work()
+	if ok {
+		println("ok")
+	}
+}
+
+func main() { start(true) }
+`
+	out := mermaidOf(t, src, Options{Start: "start"})
+	if !strings.Contains(out, `_setup -.->|go| `) {
+		t.Errorf("goroutine isn't forked off the setup node:\n%s", out)
+	}
+	out = mermaidOf(t, src, Options{Start: "start", Nest: true})
+	frame := out[strings.Index(out, `["if ok"]`):]
+	frame = frame[:strings.Index(frame, "end")]
+	if strings.Contains(frame, "_go") {
+		t.Errorf("goroutine is drawn inside the if frame:\n%s", out)
+	}
+}
+
+func TestNoiseFilterTypes(t *testing.T) {
+	src := `package main
+
+import "log"
+
+type Log struct{ entries []string }
+
+func (l *Log) Append(e string) { l.entries = append(l.entries, e) }
+
+type Audit struct{}
+
+func (Audit) Record(string) {}
+
+type Metrics struct{}
+
+func (Metrics) Inc(string) {}
+
+type Span struct{}
+
+func (Span) End() {}
+
+type Tracer struct{}
+
+func (Tracer) Start(ctx, name string) (string, Span) { return ctx + "/" + name, Span{} }
+
+var audit Audit
+
+func run(ctx string, metrics Metrics, tracer Tracer) {
+	ctx, span := tracer.Start(ctx, "op")
+	defer span.End()
+	log.Println("start")
+	metrics.Inc("runs")
+	audit.Record("run")
+	var journal Log
+	journal.Append(ctx)
+}
+
+func keep() {
+	log := &Log{}
+	log.Append("entry")
+}
+
+func main() {
+	run("main", Metrics{}, Tracer{})
+	keep()
+}
+`
+	out := mermaidOf(t, src, Options{Start: "run", Ignore: "audit"})
+	for _, dropped := range []string{"tracer.Start", "span.End", "Println", "Inc", "Record"} {
+		if strings.Contains(out, dropped) {
+			t.Errorf("%s isn't filtered:\n%s", dropped, out)
+		}
+	}
+	if !strings.Contains(out, "journal.Append") {
+		t.Errorf("journal.Append is filtered:\n%s", out)
+	}
+
+	out = mermaidOf(t, src, Options{Start: "keep"})
+	if !strings.Contains(out, "log.Append") {
+		t.Errorf("a domain variable called log is filtered:\n%s", out)
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	src := `package main
+
+type Metrics struct{}
+
+func (Metrics) Inc(string) {}
+
+func empty() {}
+
+func commented() {
+	// Nothing to do yet.
+}
+
+func count(metrics Metrics) {
+	metrics.Inc("calls")
+}
+
+func main() {
+	empty()
+	commented()
+	count(Metrics{})
+}
+`
+	for _, start := range []string{"empty", "commented"} {
+		var notes bytes.Buffer
+		out := mermaidOf(t, src, Options{Start: start, Progress: &notes})
+		if !strings.Contains(out, "ROOT --> END;") || !strings.Contains(out, `END(["End"])`) {
+			t.Errorf("%s isn't drawn as ROOT straight to End:\n%s", start, out)
+		}
+		if !strings.Contains(notes.String(), start+" has an empty body") {
+			t.Errorf("%s: no note on the empty body, got %q", start, notes.String())
+		}
+	}
+
+	// A body that is all noise once filtered, here a metrics variable
+	// typed in the same package, is left with only its return.
+	out := mermaidOf(t, src, Options{Start: "count"})
+	if strings.Contains(out, "Inc") || !strings.Contains(out, `["Return"]`) {
+		t.Errorf("count's metrics call isn't filtered:\n%s", out)
+	}
+}
+
+func TestNoBlocks(t *testing.T) {
+	src := `package main
+
+func main() {
+	println("hello")
+}
+`
+	defer func(orig func(*ast.BlockStmt, func(*ast.CallExpr) bool) *cfg.CFG) { newCFG = orig }(newCFG)
+	newCFG = func(*ast.BlockStmt, func(*ast.CallExpr) bool) *cfg.CFG { return &cfg.CFG{} }
+
+	var notes bytes.Buffer
+	out := mermaidOf(t, src, Options{Progress: &notes})
+	if !strings.Contains(out, "ROOT --> END;") || !strings.Contains(out, `END(["End"])`) {
+		t.Errorf("a graph without blocks isn't drawn as ROOT straight to End:\n%s", out)
+	}
+	if !strings.Contains(notes.String(), "no control flow could be built for main") {
+		t.Errorf("no note on the missing blocks, got %q", notes.String())
+	}
+}
+
+func TestIfWithInit(t *testing.T) {
+	src := `package main
+
+func f() int { return 1 }
+
+func check() {
+	if x := f(); x > 0 {
+		println(x)
+	}
+}
+
+func main() { check() }
+`
+	out := mermaidOf(t, src, Options{Start: "check"})
+	for _, want := range []string{
+		`B0_setup["Set x to f#40;#41;"];`,
+		"B0_setup --> B0;",
+		`B0{"x is greater than 0?"};`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestLoopWhileLabel(t *testing.T) {
+	src := `package main
+
+func count(limit int) {
+	for i := 0; i < limit; i++ {
+		println(i)
+	}
+}
+
+func main() { count(3) }
+`
+	out := mermaidOf(t, src, Options{Start: "count", Lines: true})
+	if !strings.Contains(out, `"#91;4#93; Loop while i is less than limit"`) {
+		t.Errorf("the line range doesn't lead the loop label:\n%s", out)
+	}
+	out = mermaidOf(t, src, Options{Start: "count", MaxLabel: 12})
+	if strings.Contains(out, "limit") || !strings.Contains(out, `"Loop while…"`) {
+		t.Errorf("the loop label isn't truncated:\n%s", out)
+	}
+}
+
+// writeLog records each Write it is given.
+type writeLog struct{ writes []string }
+
+func (l *writeLog) Write(p []byte) (int, error) {
+	l.writes = append(l.writes, string(p))
+	return len(p), nil
+}
+
+func TestWriteToStreams(t *testing.T) {
+	src := `package main
+
+func first() { println(1) }
+
+func second() { println(2) }
+
+func main() {
+	first()
+	second()
+}
+`
+	opts := Options{Dir: writeModule(t, src), All: true}
+	var log writeLog
+	if err := WriteTo(&log, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Each diagram is written on its own rather than as one document.
+	if len(log.writes) < 3 {
+		t.Errorf("WriteTo wrote %d times for three functions, want a write per diagram at least", len(log.writes))
+	}
+
+	results, err := GenerateEach(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(log.writes, ""), Combine(results, "mermaid"); got != want {
+		t.Errorf("WriteTo wrote:\n%s\nwant what Combine gives:\n%s", got, want)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	src := `package main
+
+type store struct{ items map[string]int }
+
+type service struct {
+	store *store
+}
+
+func (s *service) Move(to string, n int) {
+	n = 0
+	if to == "secret-endpoint" {
+		return
+	}
+	var st store
+	s.store.items[to] = n
+	_ = st
+}
+
+func main() { (&service{}).Move("x", 1) }
+`
+	out := mermaidOf(t, src, Options{Start: "service.Move", Redact: true})
+	for _, name := range []string{"service", "Move", "store", "items", "secret"} {
+		if strings.Contains(out, name) {
+			t.Errorf("output still shows %s:\n%s", name, out)
+		}
+	}
+	// The parameter called to is renamed, the word to in the phrasing isn't.
+	if !regexp.MustCompile(`"Set var\d+ to 0"`).MatchString(out) {
+		t.Errorf("the template word to was redacted:\n%s", out)
+	}
+	// The store field and the store type get stand-ins of their own.
+	if !regexp.MustCompile(`Declare var\d+ as type\d+<br><br>Set var\d+\.var\d+\.var\d+`).MatchString(out) {
+		t.Errorf("the store field and type aren't told apart:\n%s", out)
+	}
+	if !strings.Contains(out, `#quot;…#quot;`) {
+		t.Errorf("the string literal isn't blanked:\n%s", out)
+	}
+
+	// Headings, file names and call graph nodes name functions too.
+	dir := writeModule(t, src)
+	results, err := GenerateEach(Options{Dir: dir, All: true, Redact: true})
+	if err != nil {
+		t.Fatalf("GenerateEach: %v", err)
+	}
+	for _, r := range results {
+		for _, name := range []string{r.Name, r.Receiver, r.Package} {
+			if strings.Contains(name, "service") || strings.Contains(name, "Move") || strings.Contains(name, "fixture") {
+				t.Errorf("result names %q", name)
+			}
+		}
+	}
+	for _, opts := range []Options{{All: true}, {CallGraph: true}} {
+		opts.Dir, opts.Redact = dir, true
+		out, err := Generate(opts)
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		for _, name := range []string{"service", "Move", "main"} {
+			if strings.Contains(out, name) {
+				t.Errorf("All=%v CallGraph=%v: output still shows %s:\n%s", opts.All, opts.CallGraph, name, out)
+			}
+		}
+	}
+}
+
+func TestMermaidLabel(t *testing.T) {
+	tests := []struct{ label, want string }{
+		{"a | b", "a #124; b"},
+		{"m[k]", "m#91;k#93;"},
+		{"x && y", "x #amp;#amp; y"},
+		{"f(<-ch)", "f#40;#lt;-ch#41;"},
+		{"s := \"a;b\"", "s := #quot;a#59;b#quot;"},
+		{"case 1:\nreturn", "case 1:<br>return"},
+	}
+	for _, tt := range tests {
+		if got := mermaidLabel(tt.label); got != tt.want {
+			t.Errorf("mermaidLabel(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestBackEdges(t *testing.T) {
+	src := `package main
+
+func jump(n int) {
+	if n < 0 {
+		goto fail
+	}
+	println("work")
+	if n == 0 {
+		goto fail
+	}
+	return
+fail:
+	println("fail")
+}
+
+func spin(n int) {
+	goto check
+body:
+	n--
+check:
+	if n > 0 {
+		goto body
+	}
+	println("done")
+}
+
+func main() {
+	jump(1)
+	spin(2)
+}
+`
+	// The label fail is made a block at the first goto, so the second
+	// jumps back to a lower index without closing a cycle.
+	out := mermaidOf(t, src, Options{Start: "jump"})
+	if !strings.Contains(out, "B2 -->|True: goto fail| B3;") {
+		t.Errorf("backward goto isn't drawn as a plain edge:\n%s", out)
+	}
+	if strings.Contains(out, "-.->") {
+		t.Errorf("jump has no loop, but a back edge is drawn:\n%s", out)
+	}
+
+	// The loop is entered at check, a block made before body.
+	out = mermaidOf(t, src, Options{Start: "spin"})
+	if !strings.Contains(out, "B1 -->|True: goto body| B3;") {
+		t.Errorf("edge into the loop body isn't drawn as a plain edge:\n%s", out)
+	}
+	if !strings.Contains(out, "B3 -.-> B1;") {
+		t.Errorf("edge back to the loop condition isn't drawn as a back edge:\n%s", out)
+	}
+}
+
+func TestGenericFunction(t *testing.T) {
+	src := `package main
+
+func zero[T any]() (z T) { return z }
+
+func Map[T comparable, U any](items []T, f func(T) U) []U {
+	var out []U
+	for _, v := range items {
+		if v == zero[T]() {
+			continue
+		}
+		out = append(out, f(v))
+	}
+	return out
+}
+
+func main() { Map([]int{1}, func(int) string { return "" }) }
+`
+	out := mermaidOf(t, src, Options{Start: "Map"})
+	for _, want := range []string{`ROOT(["func Map#91;T, U#93;"])`, `{"v equals zero#91;T#93;#40;#41;?"}`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestPruneReturnsSelect(t *testing.T) {
+	src := `package main
+
+func wait(a chan int, b chan string) int {
+	select {
+	case <-a:
+		return 1
+	case v := <-b:
+		println(v)
+	}
+	return 0
+}
+
+func main() { wait(nil, nil) }
+`
+	out := mermaidOf(t, src, Options{Start: "wait", PruneReturns: true})
+	for _, want := range []string{`B0{"Select"};`, "B0 -->|Receive from a| B8;", "B0 -->|Receive from b into v| B5;", "B5 --> B8;", `B8(["End"])`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestDefersEnd(t *testing.T) {
+	src := `package main
+
+func unlock() {}
+
+func closeFile() {}
+
+func open(n int) error {
+	defer unlock()
+	if n < 0 {
+		return nil
+	}
+	defer closeFile()
+	println(n)
+	return nil
+}
+
+func main() { open(1) }
+`
+	out := mermaidOf(t, src, Options{Start: "open", Defers: "end"})
+	for _, want := range []string{
+		// The early return comes before closeFile is deferred.
+		"B0 -->|True| B1_defers;",
+		`B1_defers["Deferred #40;LIFO#41;:<br>unlock#40;#41;"]:::deferNode;`,
+		"B1_defers --> B1;",
+		"B0 -->|False| B2_defers;",
+		`B2_defers["Deferred #40;LIFO#41;:<br>closeFile#40;#41;<br>unlock#40;#41;"]:::deferNode;`,
+		"B2_defers --> B2;",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestLineRange(t *testing.T) {
+	src := `package main
+
+func first(n int) int {
+	if n > 0 {
+		n *= 2
+	}
+	n++
+	n--
+	if n > 10 {
+		return 1
+	}
+	return n
+}
+
+func second(s string) string {
+	if s == "" {
+		s = "x"
+	}
+	return s
+}
+
+func main() {
+	first(1)
+	second("")
+}
+`
+	// Lines 5 to 8 keep first's middle: each way in and out of it, and
+	// each function, gets a stand-in of its own.
+	out := mermaidOf(t, src, Options{Start: "first,second", FromLine: 5, ToLine: 8})
+	for _, want := range []string{
+		"R1_ROOT --> R1_B0_cut;",
+		"R1_B0_cut -->|True| R1_B1;",
+		"R1_B0_cut -->|False| R1_B2_setup;",
+		"R1_B2 -->|True| R1_B3_cut;",
+		"R1_B2 -->|False| R1_B4_cut;",
+		"R2_ROOT --> R2_B0_cut;",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Return 1") || strings.Contains(out, "Return s") {
+		t.Errorf("blocks outside the range are drawn:\n%s", out)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := writeModule(t, `package main
+
+func main() { generated(1) }
+`)
+	// gen.go exists only in the overlay, its source kept outside the module.
+	elsewhere := t.TempDir()
+	source := filepath.Join(elsewhere, "gen.go.src")
+	gen := `package main
+
+func generated(n int) {
+	if n > 0 {
+		println("positive")
+	}
+}
+`
+	if err := os.WriteFile(source, []byte(gen), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overlay := filepath.Join(elsewhere, "overlay.json")
+	spec := `{"Replace": {` + strconv.Quote(filepath.Join(dir, "gen.go")) + `: ` + strconv.Quote(source) + `}}`
+	if err := os.WriteFile(overlay, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Generate(Options{Dir: dir, Start: "generated", Overlay: overlay})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !strings.Contains(out, `ROOT(["func generated"])`) || !strings.Contains(out, "n is greater than 0?") {
+		t.Errorf("function declared in the overlay isn't drawn:\n%s", out)
+	}
+}
+
+func TestTruncateMultibyte(t *testing.T) {
+	src := `package main
+
+func déjàVérifiéÉtéCafé(s string) bool { return s != "" }
+
+func greet(s string) {
+	if déjàVérifiéÉtéCafé(s) {
+		println("🎉")
+	}
+}
+
+func main() { greet("") }
+`
+	out := mermaidOf(t, src, Options{Start: "greet", MaxLabel: 10})
+	if !utf8.ValidString(out) {
+		t.Errorf("output isn't valid UTF-8:\n%q", out)
+	}
+	if !strings.Contains(out, `{"déjàVérif…"}`) {
+		t.Errorf("the condition isn't cut on a rune boundary:\n%s", out)
+	}
+
+	for _, tt := range []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"🎉🎉🎉🎉🎉", 3, "🎉🎉…"},
+		{"ça va très bien", 9, "ça va…"},
+	} {
+		got := truncateLabel(tt.s, tt.limit)
+		if got != tt.want || !utf8.ValidString(wrapText(got, 4)) {
+			t.Errorf("truncateLabel(%q, %d) = %q, want %q", tt.s, tt.limit, got, tt.want)
+		}
+	}
+}
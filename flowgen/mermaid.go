@@ -0,0 +1,184 @@
+package flowgen
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// ==========================================
+// MERMAID RENDERER
+// ==========================================
+
+func renderMermaid(w *bufio.Writer, d *diagram) {
+	th := d.theme()
+	if th.Mermaid != "" {
+		fmt.Fprintf(w, "%%%%{init: {\"theme\": \"%s\"}}%%%%\n", th.Mermaid)
+	}
+	fmt.Fprintf(w, "flowchart %s;\n", d.Direction)
+	for _, c := range d.Comments {
+		fmt.Fprintf(w, "    %%%% %s\n", c)
+	}
+	for _, c := range th.Classes {
+		dash := ""
+		if c.Dashed {
+			dash = ",stroke-dasharray:5 5"
+		}
+		fmt.Fprintf(w, "    classDef %s fill:%s,stroke:%s,stroke-width:2px,color:%s%s;\n", c.Name, c.Fill, c.Stroke, c.Color, dash)
+	}
+	w.WriteString("\n")
+
+	// linkStyle addresses edges by the order they are declared in.
+	var panicLinks []string
+	links := 0
+	writeEdge := func(e *edge) {
+		fmt.Fprintf(w, "    %s %s %s;\n", e.From, mermaidArrow(e), e.To)
+		if e.Panic {
+			panicLinks = append(panicLinks, fmt.Sprint(links))
+		}
+		links++
+	}
+
+	edges := d.edgesByNode()
+	if len(d.Subgraphs) == 0 {
+		for _, n := range d.Nodes {
+			fmt.Fprintf(w, "    %s%s;\n", n.ID, mermaidShape(n))
+			for _, e := range edges[n.ID] {
+				writeEdge(e)
+			}
+		}
+	} else {
+		// Subgraphs must declare their nodes inside the block, so nodes
+		// come first and edges follow once every node exists.
+		top, groups := d.nodeGroups()
+		for _, n := range top {
+			fmt.Fprintf(w, "    %s%s;\n", n.ID, mermaidShape(n))
+		}
+		var writeSubgraph func(sg *subgraph, indent string)
+		writeSubgraph = func(sg *subgraph, indent string) {
+			fmt.Fprintf(w, "%ssubgraph %s [\"%s\"]\n", indent, sg.ID, mermaidLabel(sg.Label))
+			for _, n := range groups[sg] {
+				fmt.Fprintf(w, "%s    %s%s;\n", indent, n.ID, mermaidShape(n))
+			}
+			for _, child := range d.childSubgraphs(sg) {
+				writeSubgraph(child, indent+"    ")
+			}
+			w.WriteString(indent + "end\n")
+		}
+		for _, sg := range d.childSubgraphs(nil) {
+			writeSubgraph(sg, "    ")
+		}
+		for _, n := range d.Nodes {
+			for _, e := range edges[n.ID] {
+				writeEdge(e)
+			}
+		}
+	}
+
+	var extraOrder []string
+	extra := make(map[string][]string)
+	for _, n := range d.Nodes {
+		for _, c := range n.ExtraClasses {
+			if extra[c] == nil {
+				extraOrder = append(extraOrder, c)
+			}
+			extra[c] = append(extra[c], n.ID)
+		}
+	}
+
+	for _, c := range extraOrder {
+		fmt.Fprintf(w, "    class %s %s;\n", strings.Join(extra[c], ","), c)
+	}
+	for _, n := range d.Nodes {
+		if n.Tooltip != "" {
+			fmt.Fprintf(w, "    click %s callback \"%s\";\n", n.ID, mermaidTooltip(n.Tooltip))
+		}
+	}
+	if len(panicLinks) > 0 {
+		c, _ := th.class("errorNode")
+		fmt.Fprintf(w, "    linkStyle %s stroke:%s,stroke-width:2px;\n", strings.Join(panicLinks, ","), c.Fill)
+	}
+}
+
+// mermaidTooltip puts source on one line for a click tooltip, which is a
+// plain double-quoted string: entity codes would show literally.
+func mermaidTooltip(s string) string {
+	var parts []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			parts = append(parts, line)
+		}
+	}
+	return strings.ReplaceAll(strings.Join(parts, "; "), "\"", "'")
+}
+
+// mermaidEscaper replaces characters that Mermaid's parser treats as
+// syntax (shape delimiters, edge-label pipes, statement separators and
+// HTML) with Mermaid entity codes, so any Go expression is a valid label.
+var mermaidEscaper = strings.NewReplacer(
+	"#", "#35;",
+	"\"", "#quot;",
+	"&", "#amp;",
+	"<", "#lt;",
+	">", "#gt;",
+	"|", "#124;",
+	"(", "#40;",
+	")", "#41;",
+	"[", "#91;",
+	"]", "#93;",
+	"{", "#123;",
+	"}", "#125;",
+	";", "#59;",
+)
+
+// mermaidLabel escapes a label and converts its line breaks to <br>.
+func mermaidLabel(label string) string {
+	return strings.ReplaceAll(mermaidEscaper.Replace(label), "\n", "<br>")
+}
+
+func mermaidShape(n *node) string {
+	label := mermaidLabel(n.Label)
+	if n.Note != "" {
+		label += "<br><i>" + mermaidLabel(n.Note) + "</i>"
+	}
+
+	var s string
+	switch n.Shape {
+	case shapeDiamond:
+		s = fmt.Sprintf("{\"%s\"}", label)
+	case shapeCircle:
+		s = fmt.Sprintf("((\"%s\"))", label)
+	case shapeStadium:
+		s = fmt.Sprintf("([\"%s\"])", label)
+	case shapeSubroutine:
+		s = fmt.Sprintf("[[\"%s\"]]", label)
+	case shapeParallelogram:
+		s = fmt.Sprintf("[/\"%s\"/]", label)
+	default:
+		s = fmt.Sprintf("[\"%s\"]", label)
+	}
+
+	if n.Class != "" {
+		s += ":::" + n.Class
+	}
+	return s
+}
+
+func mermaidArrow(e *edge) string {
+	arrow := "-->"
+	if e.Aside {
+		arrow = "-.-"
+	} else if e.Fork {
+		arrow = "-.->"
+	} else if e.Call {
+		arrow = "==>"
+	} else if e.Back || e.Recover || e.Recurse {
+		arrow = "-.->"
+	} else if e.Long {
+		arrow = "---->"
+	}
+	if e.Label != "" {
+		arrow += "|" + mermaidLabel(e.Label) + "|"
+	}
+	return arrow
+}
@@ -0,0 +1,373 @@
+package flowgen
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// ==========================================
+// PLANTUML RENDERER
+// ==========================================
+
+// PlantUML activity diagrams are structured (if/else, loops) rather than
+// free-form graphs, so the renderer rebuilds that structure from the
+// diagram: branches rejoin at their immediate post-dominator, back edges
+// become while/repeat loops, and anything that still doesn't fit, such as
+// a goto into code already drawn, is shown as a "Go to" step.
+
+type plantUMLWriter struct {
+	w       *bufio.Writer
+	indent  int
+	theme   *theme
+	nodes   map[string]*node
+	out     map[string][]*edge // flow edges by source, without call, recover, aside or fork edges
+	backTo  map[string][]*edge // back edges by target
+	notes   map[string][]*edge // edges to side notes and goroutines by the node they hang off
+	ipdom   map[string]string
+	closing map[string]bool // back-edge sources that end an open repeat loop
+	emitted map[string]bool
+}
+
+func renderPlantUML(w *bufio.Writer, d *diagram) {
+	p := &plantUMLWriter{
+		w:       w,
+		theme:   d.theme(),
+		nodes:   make(map[string]*node),
+		out:     make(map[string][]*edge),
+		backTo:  make(map[string][]*edge),
+		notes:   make(map[string][]*edge),
+		closing: make(map[string]bool),
+		emitted: make(map[string]bool),
+	}
+	for _, n := range d.Nodes {
+		p.nodes[n.ID] = n
+	}
+	for _, e := range d.Edges {
+		if !e.flow() {
+			p.notes[e.From] = append(p.notes[e.From], e)
+		}
+		if e.Call || e.Recover || e.Recurse || !e.flow() {
+			continue
+		}
+		p.out[e.From] = append(p.out[e.From], e)
+		if e.Back {
+			p.backTo[e.To] = append(p.backTo[e.To], e)
+		}
+	}
+	p.ipdom = postDominators(d.Nodes, p.out)
+
+	p.w.WriteString("@startuml\n")
+	for _, c := range d.Comments {
+		p.line("' %s", c)
+	}
+	var roots []*node
+	for _, n := range d.Nodes {
+		if n.Class == "root" {
+			roots = append(roots, n)
+		}
+	}
+	if len(roots) == 1 {
+		p.line("title %s", plantUMLText(roots[0].Label))
+	}
+	// Several roots each get a partition with their own start. With -no-root
+	// the flow simply starts where each root led.
+	if len(roots) == 0 {
+		for _, entry := range d.Entries {
+			p.line("start")
+			p.seq(entry, "")
+		}
+	}
+	for _, root := range roots {
+		if len(roots) > 1 {
+			p.line("partition \"%s\" {", plantUMLText(root.Label))
+			p.indent++
+		}
+		p.line("start")
+		if out := p.out[root.ID]; len(out) > 0 {
+			p.seq(out[0].To, "")
+		}
+		if len(roots) > 1 {
+			p.indent--
+			p.line("}")
+		}
+	}
+	p.w.WriteString("@enduml\n")
+}
+
+func (p *plantUMLWriter) line(format string, args ...interface{}) {
+	p.w.WriteString(strings.Repeat("  ", p.indent))
+	fmt.Fprintf(p.w, format, args...)
+	p.w.WriteString("\n")
+}
+
+// seq writes the flow starting at id until it reaches stop, an open
+// loop's closing node, or a node with no way forward.
+func (p *plantUMLWriter) seq(id, stop string) {
+	for id != "" && id != stop && !p.closing[id] {
+		if p.emitted[id] {
+			p.line(":Go to %s;", plantUMLText(firstLine(p.nodes[id].Label)))
+			p.line("detach")
+			return
+		}
+		p.emitted[id] = true
+		if len(p.backTo[id]) > 0 {
+			id = p.loop(p.nodes[id])
+		} else {
+			id = p.step(p.nodes[id])
+		}
+	}
+}
+
+// step writes a single node and returns where the flow continues.
+func (p *plantUMLWriter) step(n *node) string {
+	out := p.out[n.ID]
+	if n.Shape == shapeDiamond && len(out) > 1 {
+		return p.branch(n, out)
+	}
+	if n.Shape != shapeCircle && n.Class != "endNode" {
+		p.activity(n)
+	}
+	if len(out) == 0 {
+		if n.Class == "errorNode" {
+			p.line("end")
+		} else {
+			p.line("stop")
+		}
+		return ""
+	}
+	for _, e := range out {
+		if !e.Back {
+			return e.To
+		}
+	}
+	return ""
+}
+
+func (p *plantUMLWriter) activity(n *node) {
+	color := ""
+	for _, name := range append([]string{n.Class}, n.ExtraClasses...) {
+		if c, ok := p.theme.class(name); ok {
+			color = c.Fill
+		}
+	}
+	if color != "" && !strings.HasPrefix(color, "#") {
+		color = "#" + color // PlantUML spells named colors #pink too
+	}
+	text := plantUMLText(n.Label)
+	if n.Note != "" {
+		text += "\\n<i>" + strings.ReplaceAll(plantUMLText(n.Note), "\\n", "</i>\\n<i>") + "</i>"
+	}
+	end := ";"
+	switch n.Shape {
+	case shapeSubroutine:
+		end = "|"
+	case shapeParallelogram:
+		end = "/"
+	}
+	p.line("%s:%s%s", color, text, end)
+	for _, e := range p.notes[n.ID] {
+		text := p.nodes[e.To].Label
+		if e.Label != "" {
+			text = e.Label + " " + text
+		}
+		p.line("note right")
+		p.line("  %s", plantUMLText(text))
+		p.line("end note")
+	}
+}
+
+// branch writes a decision as if/else, or as a switch when it has more
+// than two ways out. Branches that loop back are left empty.
+func (p *plantUMLWriter) branch(n *node, out []*edge) string {
+	join := p.ipdom[n.ID]
+	arm := func(e *edge) {
+		p.indent++
+		if !e.Back {
+			p.seq(e.To, join)
+		}
+		p.indent--
+	}
+
+	label := plantUMLText(n.Label)
+	if len(out) == 2 {
+		p.line("if (%s) then (%s)", label, plantUMLText(out[0].Label))
+		arm(out[0])
+		p.line("else (%s)", plantUMLText(out[1].Label))
+		arm(out[1])
+		p.line("endif")
+	} else {
+		p.line("switch (%s)", label)
+		for _, e := range out {
+			p.line("case (%s)", plantUMLText(e.Label))
+			arm(e)
+		}
+		p.line("endswitch")
+	}
+	return join
+}
+
+// loop writes a node that back edges return to. A decision whose one
+// branch leads back to it is a while loop; anything else repeats until
+// the last back edge into it.
+func (p *plantUMLWriter) loop(h *node) string {
+	out := p.out[h.ID]
+	if h.Shape == shapeDiamond && len(out) == 2 && !out[0].Back && !out[1].Back {
+		sources := make(map[string]bool)
+		for _, e := range p.backTo[h.ID] {
+			sources[e.From] = true
+		}
+		in0 := p.reaches(out[0].To, h.ID, sources)
+		in1 := p.reaches(out[1].To, h.ID, sources)
+		if in0 != in1 {
+			body, exit := out[0], out[1]
+			if in1 {
+				body, exit = out[1], out[0]
+			}
+			p.line("while (%s) is (%s)", plantUMLText(h.Label), plantUMLText(body.Label))
+			p.indent++
+			p.seq(body.To, h.ID)
+			p.indent--
+			p.line("endwhile (%s)", plantUMLText(exit.Label))
+			return exit.To
+		}
+	}
+
+	back := p.backTo[h.ID]
+	closer := p.nodes[back[len(back)-1].From]
+
+	p.line("repeat")
+	p.indent++
+	if closer != h {
+		p.closing[closer.ID] = true
+		p.seq(p.step(h), "")
+		delete(p.closing, closer.ID)
+		p.emitted[closer.ID] = true
+	}
+	if closer.Shape != shapeDiamond {
+		p.activity(closer)
+	}
+	p.indent--
+
+	var again, next *edge
+	for _, e := range p.out[closer.ID] {
+		if e.Back && e.To == h.ID {
+			again = e
+		} else if !e.Back && next == nil {
+			next = e
+		}
+	}
+	if closer.Shape == shapeDiamond && again != nil && next != nil {
+		p.line("repeat while (%s) is (%s) not (%s)", plantUMLText(closer.Label), plantUMLText(again.Label), plantUMLText(next.Label))
+		return next.To
+	}
+	p.line("repeat while ()")
+	if next != nil {
+		return next.To
+	}
+	return ""
+}
+
+// reaches reports whether forward flow from id reaches one of targets
+// without passing through avoid.
+func (p *plantUMLWriter) reaches(id, avoid string, targets map[string]bool) bool {
+	seen := make(map[string]bool)
+	var walk func(id string) bool
+	walk = func(id string) bool {
+		if id == avoid || seen[id] {
+			return false
+		}
+		seen[id] = true
+		if targets[id] {
+			return true
+		}
+		for _, e := range p.out[id] {
+			if !e.Back && walk(e.To) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(id)
+}
+
+// postDominators returns each node's immediate post-dominator over the
+// forward edges: the nearest node every path from it passes through. Nodes
+// whose paths only meet at the exit have none.
+func postDominators(nodes []*node, out map[string][]*edge) map[string]string {
+	pdom := make(map[string]map[string]bool)
+	for _, n := range nodes {
+		pdom[n.ID] = map[string]bool{n.ID: true}
+	}
+	// The forward edges form a DAG, so this settles within one pass per node.
+	changed := true
+	for pass := 0; changed && pass <= len(nodes); pass++ {
+		changed = false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			id := nodes[i].ID
+			var meet map[string]bool
+			for _, e := range out[id] {
+				if e.Back || pdom[e.To] == nil {
+					continue
+				}
+				if meet == nil {
+					meet = make(map[string]bool)
+					for x := range pdom[e.To] {
+						meet[x] = true
+					}
+				} else {
+					for x := range meet {
+						if !pdom[e.To][x] {
+							delete(meet, x)
+						}
+					}
+				}
+			}
+			if meet == nil {
+				meet = make(map[string]bool)
+			}
+			meet[id] = true
+			if !sameSet(meet, pdom[id]) {
+				pdom[id] = meet
+				changed = true
+			}
+		}
+	}
+
+	ipdom := make(map[string]string)
+	for id, set := range pdom {
+		best := ""
+		for x := range set {
+			if x != id && (best == "" || len(pdom[x]) > len(pdom[best])) {
+				best = x
+			}
+		}
+		ipdom[id] = best
+	}
+	return ipdom
+}
+
+func sameSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for x := range a {
+		if !b[x] {
+			return false
+		}
+	}
+	return true
+}
+
+// plantUMLText puts a label on one line, using PlantUML's \n for breaks.
+func plantUMLText(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,275 @@
+package flowgen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// ==========================================
+// REDACTION
+// ==========================================
+
+// redactor replaces the identifiers of the analyzed code with generic
+// names, so a diagram of private code can be shared. It works on the
+// syntax tree rather than the finished labels: while a label is phrased,
+// each identifier in the nodes it describes is renamed to its stand-in and
+// each string literal is blanked, then put back. Each distinct thing named
+// gets the same stand-in everywhere in the diagram: func1 for functions
+// and methods, type1 for types, pkg1 for packages, label1 for statement
+// labels and var1 for everything else, so a field and a type both called
+// store stay apart. Predeclared names such as len, nil and error are kept,
+// as is anything on the keep list; "std" there keeps the standard
+// library's packages and the names they declare.
+type redactor struct {
+	keep    map[string]bool
+	keepStd bool
+	std     map[string]bool       // import path -> whether it is in the standard library
+	idents  map[*ast.Ident]any    // identifier -> what it names, as collect keys it
+	kinds   map[any]string        // what is named -> "func", "type", "pkg", "label" or "var"
+	names   map[any]string        // what is named -> its stand-in
+	counts  map[string]int        // stand-ins handed out so far, by kind
+	renamed map[*ast.Ident]string // identifiers hide has renamed -> their own names
+	blanked map[*ast.BasicLit]string
+}
+
+func newRedactor(keep string) *redactor {
+	r := &redactor{
+		keep:    make(map[string]bool),
+		std:     make(map[string]bool),
+		idents:  make(map[*ast.Ident]any),
+		kinds:   make(map[any]string),
+		names:   make(map[any]string),
+		counts:  make(map[string]int),
+		renamed: make(map[*ast.Ident]string),
+		blanked: make(map[*ast.BasicLit]string),
+	}
+	for _, item := range strings.Split(keep, ",") {
+		if item = strings.TrimSpace(item); item == "std" {
+			r.keepStd = true
+		} else if item != "" {
+			r.keep[item] = true
+		}
+	}
+	return r
+}
+
+// blankString stands in for every string literal.
+const blankString = `"…"`
+
+// collect records every identifier in decl and what it names. With type
+// information that is the object it denotes, or for a package name the
+// package imported. Without it, it is where the parser resolved the
+// identifier to be declared, if it did, and otherwise the name itself;
+// anything called is taken for a function and the rest for variables.
+func (r *redactor) collect(decl *ast.FuncDecl, info *types.Info) {
+	called := make(map[*ast.Ident]bool)
+	if info == nil {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok {
+				switch fn := call.Fun.(type) {
+				case *ast.Ident:
+					called[fn] = true
+				case *ast.SelectorExpr:
+					called[fn.Sel] = true
+				}
+			}
+			return true
+		})
+		called[decl.Name] = true
+	}
+
+	ast.Inspect(decl, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || id.Name == "_" || r.keep[id.Name] {
+			return true
+		}
+		if _, seen := r.idents[id]; seen {
+			return true
+		}
+
+		var key any
+		kind := "var"
+		if info == nil {
+			if id.Obj == nil && types.Universe.Lookup(id.Name) != nil {
+				return true
+			}
+			if called[id] {
+				kind = "func"
+			}
+			if id.Obj != nil {
+				key = id.Obj.Pos()
+				switch id.Obj.Kind {
+				case ast.Fun:
+					kind = "func"
+				case ast.Typ:
+					kind = "type"
+				case ast.Lbl:
+					kind = "label"
+				}
+			} else {
+				key = kind + " " + id.Name
+			}
+		} else {
+			obj := info.ObjectOf(id)
+			if obj == nil || obj.Parent() == types.Universe || (r.keepStd && r.isStd(obj)) {
+				return true
+			}
+			key = obj
+			switch obj := obj.(type) {
+			case *types.Func:
+				kind = "func"
+			case *types.TypeName:
+				kind = "type"
+			case *types.PkgName:
+				kind = "pkg"
+				key = pkgKey(obj.Imported().Path())
+			case *types.Label:
+				kind = "label"
+			}
+		}
+		r.idents[id] = key
+		if r.kinds[key] == "" {
+			r.kinds[key] = kind
+		}
+		return true
+	})
+}
+
+// isStd reports whether obj is a standard library package or is declared
+// in one, by whether the package is found under GOROOT.
+func (r *redactor) isStd(obj types.Object) bool {
+	pkg := obj.Pkg()
+	if name, ok := obj.(*types.PkgName); ok {
+		pkg = name.Imported()
+	}
+	return pkg != nil && r.isStdPath(pkg.Path())
+}
+
+// isStdPath reports whether the package at path is found under GOROOT.
+func (r *redactor) isStdPath(path string) bool {
+	std, ok := r.std[path]
+	if !ok {
+		p, err := build.Import(path, "", build.FindOnly)
+		std = err == nil && p.Goroot
+		r.std[path] = std
+	}
+	return std
+}
+
+// standIn returns the generic name for key, numbering stand-ins of each
+// kind in the order they are first needed.
+func (r *redactor) standIn(key any) string {
+	if name, ok := r.names[key]; ok {
+		return name
+	}
+	kind := r.kinds[key]
+	r.counts[kind]++
+	name := fmt.Sprintf("%s%d", kind, r.counts[kind])
+	r.names[key] = name
+	return name
+}
+
+// hide renames every collected identifier in nodes to its stand-in and
+// blanks their string literals, until the returned function puts them
+// back. Calls may nest; only what a call changed is restored by it. On a
+// nil redactor it does nothing.
+func (r *redactor) hide(nodes ...ast.Node) (restore func()) {
+	if r == nil {
+		return func() {}
+	}
+	var ids []*ast.Ident
+	var lits []*ast.BasicLit
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		ast.Inspect(n, func(x ast.Node) bool {
+			switch x := x.(type) {
+			case *ast.Ident:
+				key, ok := r.idents[x]
+				if _, done := r.renamed[x]; ok && !done {
+					r.renamed[x] = x.Name
+					x.Name = r.standIn(key)
+					ids = append(ids, x)
+				}
+			case *ast.BasicLit:
+				if _, done := r.blanked[x]; x.Kind == token.STRING && !done {
+					r.blanked[x] = x.Value
+					x.Value = blankString
+					lits = append(lits, x)
+				}
+			}
+			return true
+		})
+	}
+	return func() {
+		for _, id := range ids {
+			id.Name = r.renamed[id]
+			delete(r.renamed, id)
+		}
+		for _, lit := range lits {
+			lit.Value = r.blanked[lit]
+			delete(r.blanked, lit)
+		}
+	}
+}
+
+// object returns the name to show for obj where it is named outside the
+// syntax hide works on, such as a callee drawn as an external node: its
+// stand-in, unless it is predeclared or kept. On a nil redactor it is
+// obj's own name.
+func (r *redactor) object(obj types.Object) string {
+	if r == nil || obj.Parent() == types.Universe || r.keep[obj.Name()] || (r.keepStd && r.isStd(obj)) {
+		return obj.Name()
+	}
+	if r.kinds[obj] == "" {
+		r.kinds[obj] = "var"
+		switch obj.(type) {
+		case *types.Func:
+			r.kinds[obj] = "func"
+		case *types.TypeName:
+			r.kinds[obj] = "type"
+		}
+	}
+	return r.standIn(obj)
+}
+
+// pkg is object for the package at path called name.
+func (r *redactor) pkg(path, name string) string {
+	if r == nil || r.keep[name] || (r.keepStd && r.isStdPath(path)) {
+		return name
+	}
+	r.kinds[pkgKey(path)] = "pkg"
+	return r.standIn(pkgKey(path))
+}
+
+// pkgKey is what a package is keyed by: its import path, which unlike a
+// *types.Package is known without type information too.
+type pkgKey string
+
+// name returns t's display name and receiver type, e.g. "Server.Handle"
+// and "Server", for where t is named outside its diagram: in headings,
+// file names and the call graph. Under -redact they are stand-ins, the
+// ones its diagram's title uses; on a nil redactor they are t's own.
+func (r *redactor) name(t target) (name, recv string) {
+	if r == nil {
+		return t.Name, receiverName(t.Pkg.Fset, t.Decl)
+	}
+	r.collect(t.Decl, t.Pkg.TypesInfo)
+	defer r.hide(signature(t.Decl)...)()
+	return funcDisplayName(t.Pkg.Fset, t.Decl), receiverName(t.Pkg.Fset, t.Decl)
+}
+
+// signature returns the parts of decl that name it: its name, type and
+// receiver, if it has one.
+func signature(decl *ast.FuncDecl) []ast.Node {
+	nodes := []ast.Node{decl.Name, decl.Type}
+	if decl.Recv != nil {
+		nodes = append(nodes, decl.Recv)
+	}
+	return nodes
+}
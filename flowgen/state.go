@@ -0,0 +1,143 @@
+package flowgen
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// ==========================================
+// MERMAID STATE DIAGRAM RENDERER
+// ==========================================
+
+// A state diagram reads blocks as states and edges as transitions. The
+// function's start and its ways out become [*], decisions become choice
+// pseudo-states whose condition moves onto the transitions leaving them,
+// and side notes become notes. State diagrams can't style single
+// transitions or frame arbitrary groups of states, so edge styles and
+// subgraphs are left out.
+
+func renderState(w *bufio.Writer, d *diagram) {
+	th := d.theme()
+	if th.Mermaid != "" {
+		fmt.Fprintf(w, "%%%%{init: {\"theme\": \"%s\"}}%%%%\n", th.Mermaid)
+	}
+	w.WriteString("stateDiagram-v2\n")
+	fmt.Fprintf(w, "    direction %s\n", dotRankDir(d.Direction))
+	for _, c := range d.Comments {
+		fmt.Fprintf(w, "    %%%% %s\n", c)
+	}
+	for _, c := range th.Classes {
+		dash := ""
+		if c.Dashed {
+			dash = ",stroke-dasharray:5 5"
+		}
+		fmt.Fprintf(w, "    classDef %s fill:%s,stroke:%s,stroke-width:2px,color:%s%s\n", c.Name, c.Fill, c.Stroke, c.Color, dash)
+	}
+	w.WriteString("\n")
+
+	// With one root the start pseudo-state stands in for it; several keep
+	// their titles as states so each function can be told apart.
+	var roots int
+	for _, n := range d.Nodes {
+		if n.Class == "root" {
+			roots++
+		}
+	}
+	start := make(map[string]bool)
+	for _, entry := range d.Entries {
+		fmt.Fprintf(w, "    [*] --> %s\n", entry)
+	}
+	notes := make(map[string]bool)
+	out := make(map[string]int)
+	for _, e := range d.Edges {
+		if e.Aside {
+			notes[e.To] = true
+		}
+		if e.flow() {
+			out[e.From]++
+		}
+	}
+
+	nodes := make(map[string]*node)
+	for _, n := range d.Nodes {
+		nodes[n.ID] = n
+		switch {
+		case n.Class == "root" && roots == 1:
+			start[n.ID] = true
+		case notes[n.ID]:
+		case n.Shape == shapeDiamond:
+			fmt.Fprintf(w, "    state %s <<choice>>\n", n.ID)
+		default:
+			fmt.Fprintf(w, "    state \"%s\" as %s\n", stateLabel(n), n.ID)
+		}
+	}
+
+	edges := d.edgesByNode()
+	for _, n := range d.Nodes {
+		for _, e := range edges[n.ID] {
+			if e.Aside {
+				fmt.Fprintf(w, "    note right of %s\n        %s\n    end note\n", e.From, mermaidLabel(nodes[e.To].Label))
+				continue
+			}
+			from := e.From
+			if start[from] {
+				from = "[*]"
+			}
+			label := e.Label
+			if src := nodes[e.From]; src != nil && src.Shape == shapeDiamond {
+				label = choiceLabel(src.Label, e.Label)
+			}
+			if label == "" {
+				fmt.Fprintf(w, "    %s --> %s\n", from, e.To)
+			} else {
+				fmt.Fprintf(w, "    %s --> %s: %s\n", from, e.To, mermaidLabel(label))
+			}
+		}
+		if out[n.ID] == 0 && !notes[n.ID] && !start[n.ID] {
+			fmt.Fprintf(w, "    %s --> [*]\n", n.ID)
+		}
+	}
+
+	classes := make(map[string][]string)
+	var order []string
+	for _, n := range d.Nodes {
+		if start[n.ID] || notes[n.ID] || n.Shape == shapeDiamond {
+			continue
+		}
+		for _, c := range append([]string{n.Class}, n.ExtraClasses...) {
+			if c == "" {
+				continue
+			}
+			if classes[c] == nil {
+				order = append(order, c)
+			}
+			classes[c] = append(classes[c], n.ID)
+		}
+	}
+	for _, c := range order {
+		fmt.Fprintf(w, "    class %s %s\n", strings.Join(classes[c], ","), c)
+	}
+}
+
+// stateLabel is a state's description: its label, then any note.
+func stateLabel(n *node) string {
+	label := mermaidLabel(n.Label)
+	if n.Note != "" {
+		label += "<br><i>" + mermaidLabel(n.Note) + "</i>"
+	}
+	return label
+}
+
+// choiceLabel puts a decision's condition on a transition leaving it,
+// followed by the branch taken, e.g. "Is ok? True".
+func choiceLabel(cond, branch string) string {
+	cond = strings.Join(strings.Fields(cond), " ")
+	switch {
+	case branch == "":
+		return cond
+	case strings.HasSuffix(cond, "?"):
+		return cond + " " + branch
+	}
+	return cond + ": " + branch
+}
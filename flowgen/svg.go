@@ -0,0 +1,67 @@
+package flowgen
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ==========================================
+// SVG RENDERER (via the Mermaid CLI)
+// ==========================================
+
+// renderSVG draws the Mermaid rendering to SVG with mmdc and copies it to
+// w. mmdc only reads and writes files, so both sides go through a
+// temporary directory.
+func renderSVG(w *bufio.Writer, d *diagram) error {
+	dir, err := os.MkdirTemp("", "flowgen")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir for mmdc: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "flow.mmd")
+	out := filepath.Join(dir, "flow.svg")
+	if err := writeMermaidFile(in, d); err != nil {
+		return fmt.Errorf("failed to write mmdc input: %v", err)
+	}
+
+	args := []string{"-i", in, "-o", out}
+	if bg := d.theme().Background; bg != "" {
+		args = append(args, "-b", bg)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("mmdc", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mmdc failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	svg, err := os.Open(out)
+	if err != nil {
+		return fmt.Errorf("failed to read mmdc output: %v", err)
+	}
+	defer svg.Close()
+	_, err = w.ReadFrom(svg)
+	return err
+}
+
+// writeMermaidFile renders d as a bare Mermaid flowchart into the file at
+// path, for mmdc to read.
+func writeMermaidFile(path string, d *diagram) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	renderMermaid(w, d)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,207 @@
+package flowgen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// ==========================================
+// THEMES
+// ==========================================
+
+type classStyle struct {
+	Name   string
+	Fill   string
+	Stroke string
+	Color  string
+	Dashed bool // outline drawn dashed, where the format supports it
+}
+
+// theme holds every color the renderers use, so switching palettes or
+// overriding one color is a single place to look.
+type theme struct {
+	Mermaid    string // Mermaid built-in theme for unstyled nodes; "" keeps Mermaid's default
+	Background string // DOT graph background; "" keeps Graphviz's default
+	NodeFill   string // plain nodes in DOT
+	NodeText   string
+	Line       string // DOT edges and outlines
+	Classes    []classStyle
+}
+
+var themes = map[string]theme{
+	"light": {
+		NodeFill: "#ffffff",
+		NodeText: "#000000",
+		Line:     "#000000",
+		Classes: []classStyle{
+			{Name: "root", Fill: "#007acc", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "successNode", Fill: "#2ea043", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "endNode", Fill: "#24292f", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "errorNode", Fill: "#cc3300", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "earlyReturn", Fill: "#d4a017", Stroke: "#ffffff", Color: "#000000"},
+			{Name: "mergeNode", Fill: "#555555", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "deferNode", Fill: "#6f42c1", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "goroutineNode", Fill: "#0e8a8a", Stroke: "#ffffff", Color: "#ffffff"},
+			{Name: "externalNode", Fill: "#d0d7de", Stroke: "#57606a", Color: "#24292f"},
+			{Name: "highlight", Fill: "#ffd33d", Stroke: "#b08800", Color: "#000000"},
+			{Name: "noiseNode", Fill: "#f2f2f2", Stroke: "#bbbbbb", Color: "#888888"},
+			{Name: "unreachableNode", Fill: "#eaeef2", Stroke: "#8c959f", Color: "#6e7781", Dashed: true},
+		},
+	},
+	"dark": {
+		Mermaid:    "dark",
+		Background: "#0d1117",
+		NodeFill:   "#161b22",
+		NodeText:   "#e6edf3",
+		Line:       "#8b949e",
+		Classes: []classStyle{
+			{Name: "root", Fill: "#1f4b99", Stroke: "#58a6ff", Color: "#e6edf3"},
+			{Name: "successNode", Fill: "#1a4d2e", Stroke: "#3fb950", Color: "#e6edf3"},
+			{Name: "endNode", Fill: "#30363d", Stroke: "#e6edf3", Color: "#e6edf3"},
+			{Name: "errorNode", Fill: "#67060c", Stroke: "#f85149", Color: "#e6edf3"},
+			{Name: "earlyReturn", Fill: "#5a3e00", Stroke: "#d29922", Color: "#e6edf3"},
+			{Name: "mergeNode", Fill: "#30363d", Stroke: "#8b949e", Color: "#e6edf3"},
+			{Name: "deferNode", Fill: "#3c1e70", Stroke: "#a371f7", Color: "#e6edf3"},
+			{Name: "goroutineNode", Fill: "#0b3d3d", Stroke: "#39c5cf", Color: "#e6edf3"},
+			{Name: "externalNode", Fill: "#21262d", Stroke: "#8b949e", Color: "#c9d1d9"},
+			{Name: "highlight", Fill: "#6e5600", Stroke: "#d29922", Color: "#f0f6fc"},
+			{Name: "noiseNode", Fill: "#21262d", Stroke: "#30363d", Color: "#6e7681"},
+			{Name: "unreachableNode", Fill: "#161b22", Stroke: "#6e7681", Color: "#8b949e", Dashed: true},
+		},
+	},
+	"neutral": {
+		Mermaid:  "neutral",
+		NodeFill: "#ffffff",
+		NodeText: "#333333",
+		Line:     "#666666",
+		Classes: []classStyle{
+			{Name: "root", Fill: "#e0e0e0", Stroke: "#666666", Color: "#000000"},
+			{Name: "successNode", Fill: "#f0f0f0", Stroke: "#666666", Color: "#000000"},
+			{Name: "endNode", Fill: "#424242", Stroke: "#333333", Color: "#ffffff"},
+			{Name: "errorNode", Fill: "#bdbdbd", Stroke: "#333333", Color: "#000000"},
+			{Name: "earlyReturn", Fill: "#e8e8e8", Stroke: "#333333", Color: "#000000"},
+			{Name: "mergeNode", Fill: "#9e9e9e", Stroke: "#666666", Color: "#ffffff"},
+			{Name: "deferNode", Fill: "#d6d6d6", Stroke: "#666666", Color: "#000000"},
+			{Name: "goroutineNode", Fill: "#ffffff", Stroke: "#333333", Color: "#000000"},
+			{Name: "externalNode", Fill: "#eeeeee", Stroke: "#666666", Color: "#333333"},
+			{Name: "highlight", Fill: "#fff3b0", Stroke: "#666666", Color: "#000000"},
+			{Name: "noiseNode", Fill: "#fafafa", Stroke: "#cccccc", Color: "#999999"},
+			{Name: "unreachableNode", Fill: "#eeeeee", Stroke: "#999999", Color: "#777777", Dashed: true},
+		},
+	},
+}
+
+// newTheme picks the palette named by -theme and applies the individual
+// color overrides on top of it.
+func newTheme(opts Options) (*theme, error) {
+	name := opts.Theme
+	if name == "" {
+		name = "light"
+	}
+	base, ok := themes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown theme '%s' (expected light, dark or neutral)", opts.Theme)
+	}
+
+	t := base
+	t.Classes = append([]classStyle(nil), base.Classes...)
+	for i := range t.Classes {
+		switch t.Classes[i].Name {
+		case "root":
+			if opts.RootColor != "" {
+				t.Classes[i].Fill = opts.RootColor
+			}
+		case "successNode":
+			if opts.EndColor != "" {
+				t.Classes[i].Fill = opts.EndColor
+			}
+		}
+	}
+	return &t, nil
+}
+
+func (d *diagram) theme() *theme {
+	t := d.Theme
+	if t == nil {
+		t, _ = newTheme(Options{})
+	}
+	if len(d.Packages) == 0 && len(d.Entries) == 0 && !d.Diff {
+		return t
+	}
+	// Without ROOT nodes their class goes unused, so it isn't declared.
+	adjusted := *t
+	adjusted.Classes = nil
+	for _, c := range t.Classes {
+		if c.Name != "root" || len(d.Entries) == 0 {
+			adjusted.Classes = append(adjusted.Classes, c)
+		}
+	}
+	for _, pkg := range d.Packages {
+		adjusted.Classes = append(adjusted.Classes, packageClass(pkg, t.Background != ""))
+	}
+	if d.Diff {
+		adjusted.Classes = append(adjusted.Classes, diffClasses(t.Background != "")...)
+	}
+	return &adjusted
+}
+
+// packageClass styles the blocks calling into pkg for -color-by-package.
+// The hue comes from a hash of the name, so a package keeps its color
+// from one diagram and one run to the next.
+func packageClass(pkg string, dark bool) classStyle {
+	h := fnv.New32a()
+	h.Write([]byte(pkg))
+	hue := float64(h.Sum32() % 360)
+	if dark {
+		return classStyle{Name: "pkg_" + pkg, Fill: hslHex(hue, 0.45, 0.28), Stroke: hslHex(hue, 0.6, 0.6), Color: "#e6edf3"}
+	}
+	return classStyle{Name: "pkg_" + pkg, Fill: hslHex(hue, 0.7, 0.85), Stroke: hslHex(hue, 0.5, 0.45), Color: "#000000"}
+}
+
+// diffClasses style the blocks -diff finds added and removed.
+func diffClasses(dark bool) []classStyle {
+	if dark {
+		return []classStyle{
+			{Name: "addedNode", Fill: "#1a4d2e", Stroke: "#3fb950", Color: "#e6edf3"},
+			{Name: "removedNode", Fill: "#67060c", Stroke: "#f85149", Color: "#e6edf3", Dashed: true},
+		}
+	}
+	return []classStyle{
+		{Name: "addedNode", Fill: "#dafbe1", Stroke: "#2ea043", Color: "#000000"},
+		{Name: "removedNode", Fill: "#ffebe9", Stroke: "#cf222e", Color: "#000000", Dashed: true},
+	}
+}
+
+// hslHex converts a hue in degrees and saturation and lightness in [0, 1]
+// to a #rrggbb color.
+func hslHex(hue, s, l float64) string {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g = c, x
+	case hue < 120:
+		r, g = x, c
+	case hue < 180:
+		g, b = c, x
+	case hue < 240:
+		g, b = x, c
+	case hue < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return fmt.Sprintf("#%02x%02x%02x", int((r+m)*255+0.5), int((g+m)*255+0.5), int((b+m)*255+0.5))
+}
+
+func (t *theme) class(name string) (classStyle, bool) {
+	for _, c := range t.Classes {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return classStyle{}, false
+}
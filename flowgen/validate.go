@@ -0,0 +1,52 @@
+package flowgen
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ==========================================
+// MERMAID VALIDATION
+// ==========================================
+
+// mermaidMarkup is what an escaped label may legitimately contain: entity
+// codes, line breaks and the italics around notes.
+var mermaidMarkup = regexp.MustCompile(`#\w+;|<br>|</?i>`)
+
+// validateMermaid checks that every label in d reaches Mermaid escaped, so
+// an escaping bug is reported against the block that caused it instead of
+// surfacing as a diagram that fails to render.
+func validateMermaid(d *diagram) error {
+	for _, n := range d.Nodes {
+		label := mermaidLabel(n.Label)
+		if n.Note != "" {
+			label += "<br><i>" + mermaidLabel(n.Note) + "</i>"
+		}
+		if err := checkMermaidLabel(label); err != nil {
+			return fmt.Errorf("node %s %q: %v", n.ID, n.Label, err)
+		}
+		if strings.Contains(mermaidTooltip(n.Tooltip), "\"") {
+			return fmt.Errorf("node %s: tooltip contains an unescaped '\"'", n.ID)
+		}
+	}
+	for _, e := range d.Edges {
+		if err := checkMermaidLabel(mermaidLabel(e.Label)); err != nil {
+			return fmt.Errorf("edge %s -> %s %q: %v", e.From, e.To, e.Label, err)
+		}
+	}
+	for _, sg := range d.Subgraphs {
+		if err := checkMermaidLabel(mermaidLabel(sg.Label)); err != nil {
+			return fmt.Errorf("subgraph %s %q: %v", sg.ID, sg.Label, err)
+		}
+	}
+	return nil
+}
+
+func checkMermaidLabel(label string) error {
+	rest := mermaidMarkup.ReplaceAllString(label, "")
+	if i := strings.IndexAny(rest, "\"#&<>|()[]{};\n"); i >= 0 {
+		return fmt.Errorf("unescaped %q in label", rest[i])
+	}
+	return nil
+}
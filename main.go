@@ -2,497 +2,747 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"go/ast"
-	"go/printer"
-	"go/token"
+	"go/format"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
-	"golang.org/x/tools/go/cfg"
-	"golang.org/x/tools/go/packages"
+	"github.com/dan-dawson/flowgen/flowgen"
 )
 
 func main() {
-	startFunc := flag.String("start", "main", "The starting function to analyze (e.g., 'main' or 'manager.CreateBasket')")
-	outFile := flag.String("out", "flow.md", "The file to write the Mermaid diagram to")
+	startFunc := flag.String("start", "main", "The starting function to analyze (e.g., 'main', 'manager.CreateBasket' or '(*Server).Handle'; prefix a package path such as 'example.com/app/server.Run' to pick between packages; separate several with commas to draw them in one diagram)")
+	outFile := flag.String("out", "flow.md", "The file to write the diagram to ('-' for stdout, or a directory with -all or -match)")
+	format := flag.String("format", "mermaid", "Output format: 'mermaid' (Markdown fenced block), 'state' (Mermaid stateDiagram-v2), 'dot' (Graphviz digraph) or 'plantuml' (activity diagram) or 'svg' (rendered with mmdc, the Mermaid CLI)")
+	splitAt := flag.Int("split-at", 0, "Split functions of more than this many blocks into parts linked by 'continues on part N' connectors (0 to never split)")
+	resolveConsts := flag.Bool("resolve-consts", false, "Follow named constants in comparisons and switch cases with their values, e.g. 'status equals StatusActive (2)'")
+	syncHints := flag.Bool("sync-hints", false, "Mark sync.Mutex and sync.WaitGroup calls, e.g. '🔒 Acquire lock mu', so critical sections and waits stand out")
+	diff := flag.String("diff", "", "Directory holding another version of the code, e.g. a git worktree of the base branch; blocks added since it are colored green and removed ones red")
+	nest := flag.Bool("nest", false, "Frame blocks in subgraphs by the if, for, switch or select statement they belong to, nested as in the source")
+	pos := flag.String("pos", "", "Draw the function enclosing this source position, file.go:line:col (or file.go:line), instead of -start; for editor integrations")
+	legend := flag.Bool("legend", false, "Add a key, apart from the flow, explaining the shapes, colors and edge styles the diagram uses")
+	noRoot := flag.Bool("no-root", false, "Leave out the node naming the function and start the diagram at its first block")
+	direction := flag.String("direction", "TD", "Layout direction: TD, LR, BT or RL")
+	allFuncs := flag.Bool("all", false, "Analyze every function in the loaded packages instead of -start")
+	callGraph := flag.Bool("callgraph", false, "Draw each loaded package's functions and the calls between them instead of a function's flow")
+	match := flag.String("match", "", "Analyze every function whose name (or Type.Method) matches this regular expression instead of -start")
+	trueLabel := flag.String("true-label", "True", "Label for the edge taken when a condition holds")
+	falseLabel := flag.String("false-label", "False", "Label for the edge taken when a condition doesn't hold")
+	loopLabel := flag.String("loop-label", "Next", "Label for the edge into a loop's next iteration")
+	defers := flag.String("defers", "inline", "Where to show deferred calls: 'inline' (where registered), 'end' (before each return, LIFO) or 'hide'")
+	colorByPackage := flag.Bool("color-by-package", false, "Color each block by the package it calls into, with a legend, to show where a function crosses package boundaries")
+	highlight := flag.String("highlight", "", "Highlight blocks whose label contains this text or matches it as a regular expression")
+	maxLabel := flag.Int("maxlabel", 80, "Truncate each statement's label to this many characters (0 for no limit)")
+	shorten := flag.Int("shorten", 0, "Cut selector chains in labels to their last N names, e.g. 's.store.users.FindByID' to '…FindByID' with 1 (0 keeps them whole)")
+	depth := flag.Int("depth", 0, "Expand calls to functions in the loaded packages as subgraphs, up to this many levels deep")
+	entryExpand := flag.Bool("entry-expand", false, "Always expand the start function's calls into its own package one level deep, whatever -depth is")
+	sortOrder := flag.String("sort", "blocks", "Order to declare nodes in: 'blocks' (control-flow graph order) or 'topo' (topological, ignoring loops), which can untangle the layout")
+	stableIDs := flag.Bool("stable-ids", false, "Derive node IDs from a hash of each block's text, so unchanged blocks keep their IDs across edits and diffs stay small")
+	fromLine := flag.Int("from-line", 0, "Draw only the part of the function from this source line on, with '...' where the flow leaves the range")
+	toLine := flag.Int("to-line", 0, "Draw only the part of the function up to this source line")
+	collapse := flag.Bool("collapse", false, "Merge chains of straight-line blocks into a single node")
+	tags := flag.String("tags", "", "Comma-separated build tags to load packages with")
+	goos := flag.String("goos", "", "Load packages as built for this GOOS (defaults to the host's)")
+	goarch := flag.String("goarch", "", "Load packages as built for this GOARCH (defaults to the host's)")
+	overlay := flag.String("overlay", "", "JSON file in go build -overlay format, to analyze sources that aren't on disk, such as generated code")
+	tests := flag.Bool("tests", false, "Also load _test.go files, so -start can name test functions and helpers")
+	showNoise := flag.Bool("show-noise", false, "Keep filtered calls visible as greyed-out notes beside their block")
+	noFilter := flag.Bool("no-filter", false, "Keep every logging, metrics and tracing call in the flow (overrides -show-noise)")
+	idiomaticErrors := flag.Bool("idiomatic-errors", false, "Phrase 'err != nil' checks as 'Check err' with 'on error' and 'success' branches")
+	maxComplexity := flag.Int("max-complexity", 0, "Exit with status 2 if any analyzed function's cyclomatic complexity exceeds this (0 for no limit)")
+	complexity := flag.Bool("complexity", false, "Also note each function's cyclomatic complexity as a comment in the diagram")
+	mergeReturns := flag.Bool("merge-returns", false, "Draw returns that read the same, such as several 'return nil', as one shared node")
+	pruneReturns := flag.Bool("prune-returns", false, "Route every return to one shared End node instead of drawing each return")
+	shapes := flag.Bool("shapes", false, "Vary block shapes by statement kind: subroutines for calls, parallelograms for channel operations")
+	compact := flag.Bool("compact", false, "Label each block with a single line, its last statement and how many more there are; the full source moves to a tooltip")
+	tooltips := flag.Bool("tooltips", false, "Attach each block's full Go source as a hover tooltip (Mermaid and DOT)")
+	comments := flag.Bool("comments", false, "Show the comments written on or above each statement in italics under its block")
+	lines := flag.Bool("lines", false, "Prefix each statement with its source line range, e.g. [12-18]")
+	themeName := flag.String("theme", "light", "Color theme: light, dark or neutral")
+	rootColor := flag.String("root-color", "", "Fill color for the function's root node, overriding the theme")
+	endColor := flag.String("end-color", "", "Fill color for successful exits, overriding the theme")
+	timeout := flag.Duration("timeout", 0, "Give up loading packages after this long, e.g. 30s or 2m (0 waits indefinitely)")
+	withSource := flag.Bool("with-source", false, "Follow each Mermaid diagram with the function's source in a go code block")
+	title := flag.String("title", "", "Put a '# title' heading and a line naming the function and package above the diagram (Markdown output only)")
+	redact := flag.Bool("redact", false, "Replace identifiers with generic names (var1, func1, type1, pkg1) so diagrams of private code can be shared")
+	keep := flag.String("keep", "", "With -redact, comma-separated identifiers to leave as they are; 'std' keeps standard library names")
+	debug := flag.Bool("debug", false, "Print each function's cfg blocks to stderr before drawing: statements, successors and how each is treated")
+	inlineDoc := flag.Bool("inline-doc", false, "Write each diagram into its function's doc comment, between '// flowgen:begin' and '// flowgen:end', instead of to -out")
+	validate := flag.Bool("validate", false, "Check that every Mermaid label is escaped and report the first block that isn't, without writing anything")
+	watch := flag.Bool("watch", false, "Keep running and regenerate the output whenever a .go file under the target changes")
+	crlf := flag.Bool("crlf", runtime.GOOS == "windows", "Write output files with CRLF line endings (the default on Windows)")
+	stdin := flag.Bool("stdin", false, "Read a single Go source file from standard input instead of loading packages")
+	quietFlag := flag.Bool("quiet", false, "Print only errors: no progress, complexity or success messages (implied by -out -)")
 
 	// --- NEW: Dynamic Exclusion Flag ---
-	excludeFlag := flag.String("exclude", "metrics,span,tracing,log,logger", "Comma-separated list of packages/variables to exclude")
+	excludeFlag := flag.String("exclude", flowgen.DefaultExclude, "Comma-separated list of packages/variables to exclude (replaces the defaults)")
+	ignoreFlag := flag.String("ignore", "", "Comma-separated packages/variables to exclude in addition to -exclude")
+	ignoreRegex := flag.String("ignore-regex", "", "Also exclude calls whose base identifier matches this regular expression")
+	flag.Usage = usage
 	flag.Parse()
 
 	targetDir := "."
 	if len(flag.Args()) > 0 {
 		targetDir = flag.Args()[0]
 	}
-
-	mermaidCode, err := analyzeCFG(targetDir, *startFunc, *excludeFlag)
-	if err != nil {
+	if err := loadConfig(targetDir); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-
-	output := fmt.Sprintf("```mermaid\nflowchart TD;\n%s```\n", mermaidCode)
-
-	if *outFile == "-" {
-		fmt.Println(output)
-	} else {
-		err = os.WriteFile(*outFile, []byte(output), 0644)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Printf("Successfully generated %s for %s()\n", *outFile, *startFunc)
+	quiet = *quietFlag || *outFile == "-"
+
+	opts := flowgen.Options{
+		Dir:             targetDir,
+		Start:           *startFunc,
+		All:             *allFuncs,
+		CallGraph:       *callGraph,
+		Match:           *match,
+		Exclude:         *excludeFlag,
+		Ignore:          *ignoreFlag,
+		IgnoreRegex:     *ignoreRegex,
+		Format:          *format,
+		Direction:       *direction,
+		NoRoot:          *noRoot,
+		Legend:          *legend,
+		ResolveConsts:   *resolveConsts,
+		SyncHints:       *syncHints,
+		Nest:            *nest,
+		Pos:             *pos,
+		Diff:            *diff,
+		SplitAt:         *splitAt,
+		Collapse:        *collapse,
+		Sort:            *sortOrder,
+		StableIDs:       *stableIDs,
+		Defers:          *defers,
+		TrueLabel:       *trueLabel,
+		FalseLabel:      *falseLabel,
+		LoopLabel:       *loopLabel,
+		Highlight:       *highlight,
+		ColorByPackage:  *colorByPackage,
+		FromLine:        *fromLine,
+		ToLine:          *toLine,
+		Depth:           *depth,
+		EntryExpand:     *entryExpand,
+		MaxLabel:        *maxLabel,
+		Shorten:         *shorten,
+		Lines:           *lines,
+		Comments:        *comments,
+		Tooltips:        *tooltips,
+		Compact:         *compact,
+		Shapes:          *shapes,
+		PruneReturns:    *pruneReturns,
+		MergeReturns:    *mergeReturns,
+		Complexity:      *complexity,
+		WithSource:      *withSource,
+		Validate:        *validate,
+		Redact:          *redact,
+		Keep:            *keep,
+		IdiomaticErrors: *idiomaticErrors,
+		ShowNoise:       *showNoise,
+		NoFilter:        *noFilter,
+		Theme:           *themeName,
+		RootColor:       *rootColor,
+		EndColor:        *endColor,
+		Tags:            *tags,
+		GOOS:            *goos,
+		GOARCH:          *goarch,
+		Tests:           *tests,
+		Overlay:         *overlay,
+		Timeout:         *timeout,
+		Progress:        os.Stderr,
 	}
-}
-
-// ==========================================
-// DEV MODE (Low-Level CFG)
-// ==========================================
-
-func analyzeCFG(path string, startFunc string, excludeStr string) (string, error) {
-	config := &packages.Config{
-		Mode: packages.NeedName | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedFiles | packages.NeedCompiledGoFiles,
-		Dir:  path,
+	if quiet {
+		opts.Progress = nil
+	}
+	if *debug {
+		opts.Debug = os.Stderr
+	}
+	if *stdin {
+		opts.Source = os.Stdin
 	}
 
-	pkgs, err := packages.Load(config, "./...")
-	if err != nil || packages.PrintErrors(pkgs) > 0 {
-		return "", fmt.Errorf("failed to load packages")
+	if opts.Format == "svg" && (opts.All || opts.Match != "") && !isDirTarget(*outFile) {
+		fmt.Fprintf(os.Stderr, "Error: -format svg writes one file per function; point -out at a directory\n")
+		os.Exit(1)
 	}
 
-	targetDecl, fset, err := findStartingFunction(pkgs, startFunc)
-	if err != nil {
-		return "", err
+	if *title != "" && ((opts.Format != "mermaid" && opts.Format != "state") || isDirTarget(*outFile) || !(*outFile == "-" || strings.EqualFold(filepath.Ext(*outFile), ".md"))) {
+		fmt.Fprintf(os.Stderr, "Error: -title needs Markdown output: -format mermaid or state with -out a .md file or '-'\n")
+		os.Exit(1)
 	}
 
-	flowGraph := cfg.New(targetDecl.Body, func(call *ast.CallExpr) bool { return true })
+	if *inlineDoc && (opts.Format != "mermaid" && opts.Format != "state" || opts.CallGraph || opts.Source != nil) {
+		fmt.Fprintf(os.Stderr, "Error: -inline-doc writes Mermaid into the analyzed functions' source files; use it with -format mermaid or state, without -callgraph or -stdin\n")
+		os.Exit(1)
+	}
 
-	// --- NEW: Parse the exclusion list into a fast lookup map ---
-	excludeMap := make(map[string]bool)
-	for _, item := range strings.Split(excludeStr, ",") {
-		trimmed := strings.TrimSpace(item)
-		if trimmed != "" {
-			excludeMap[trimmed] = true
+	generate := func() ([]flowgen.Result, error) {
+		results, err := flowgen.GenerateEach(opts)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	for _, block := range flowGraph.Blocks {
-		block.Nodes = filterNoise(block.Nodes, excludeMap)
-	}
+		if !opts.CallGraph {
+			for _, r := range results {
+				status(os.Stderr, "%s: cyclomatic complexity %d\n", r.Name, r.Complexity)
+			}
+		}
 
-	// Build predecessor map to detect merge points
-	preds := make(map[int32][]int32)
-	for _, b := range flowGraph.Blocks {
-		for _, succ := range b.Succs {
-			preds[succ.Index] = append(preds[succ.Index], b.Index)
+		if *validate {
+			what := "functions"
+			if opts.CallGraph {
+				what = "call graphs"
+			}
+			status(os.Stdout, "Mermaid output for %d %s is valid\n", len(results), what)
+			return results, nil
 		}
-	}
 
-	loopHeaders := make(map[int32]bool)
-	for _, b := range flowGraph.Blocks {
-		if isEmptyPassThrough(b, preds) {
-			continue
+		if *inlineDoc {
+			writeInlineDocs(results)
+			return results, nil
 		}
-		for _, succ := range b.Succs {
-			dest := resolveDestination(succ, preds)
-			if dest.Index <= b.Index {
-				loopHeaders[dest.Index] = true
+
+		header := markdownHeader(*title, results, opts.CallGraph)
+		if len(results) == 1 && !opts.All && opts.Match == "" {
+			subject := results[0].Name + "()"
+			if opts.CallGraph {
+				subject = "the call graph of package " + results[0].Package
+			}
+			writeSingle(header+results[0].Output, *outFile, subject, *crlf && opts.Format != "svg")
+		} else if isDirTarget(*outFile) {
+			writeDir(results, *outFile, opts.Format, *crlf)
+		} else {
+			subject := fmt.Sprintf("%d functions", len(results))
+			if opts.CallGraph {
+				subject = fmt.Sprintf("the call graphs of %d packages", len(results))
 			}
+			writeSingle(header+flowgen.Combine(results, opts.Format), *outFile, subject, *crlf)
 		}
+		return results, nil
 	}
 
-	var buf bytes.Buffer
-	buf.WriteString("    classDef root fill:#007acc,stroke:#fff,stroke-width:2px,color:#fff;\n")
-	buf.WriteString("    classDef successNode fill:#2ea043,stroke:#fff,stroke-width:2px,color:#fff;\n")
-	buf.WriteString("    classDef errorNode fill:#cc3300,stroke:#fff,stroke-width:2px,color:#fff;\n")
-	buf.WriteString("    classDef mergeNode fill:#555,stroke:#fff,stroke-width:2px,color:#fff;\n\n")
+	// In watch mode a failed run is reported and the next save retried,
+	// since the code is usually mid-edit.
+	if *watch {
+		if opts.Source != nil {
+			fmt.Fprintf(os.Stderr, "Error: -watch needs files to watch and can't read from -stdin\n")
+			os.Exit(1)
+		}
+		if _, err := generate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		watchFiles(targetDir, func() {
+			if _, err := generate(); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] Error: %v\n", time.Now().Format("15:04:05"), err)
+			} else {
+				status(os.Stderr, "[%s] Regenerated\n", time.Now().Format("15:04:05"))
+			}
+		})
+	}
 
-	buf.WriteString(fmt.Sprintf("    ROOT([\"func %s\"]):::root\n", startFunc))
-	firstBlock := resolveDestination(flowGraph.Blocks[0], preds)
-	buf.WriteString(fmt.Sprintf("    ROOT --> %s;\n", getEntryPoint(firstBlock)))
+	results, err := generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	for _, block := range flowGraph.Blocks {
-		if isEmptyPassThrough(block, preds) {
-			continue
+	// The diagrams are still written, so a failing CI run has them to show.
+	if *maxComplexity > 0 {
+		failed := false
+		for _, r := range results {
+			if r.Complexity > *maxComplexity {
+				fmt.Fprintf(os.Stderr, "%s: cyclomatic complexity %d exceeds -max-complexity %d\n", r.Name, r.Complexity, *maxComplexity)
+				failed = true
+			}
 		}
+		if failed {
+			os.Exit(2)
+		}
+	}
+}
 
-		isCond := len(block.Succs) == 2
-		isSplit := len(block.Nodes) > 1 && isCond
-		label := formatNodes(fset, block.Nodes, isCond)
-
-		if isSplit {
-			setupLabel := formatNodes(fset, block.Nodes[:len(block.Nodes)-1], false)
-			condLabel := formatNodes(fset, block.Nodes[len(block.Nodes)-1:], true)
+// ==========================================
+// WATCH
+// ==========================================
 
-			buf.WriteString(fmt.Sprintf("    B%d_setup[\"%s\"];\n", block.Index, setupLabel))
-			buf.WriteString(fmt.Sprintf("    B%d{\"%s\"};\n", block.Index, condLabel))
-			buf.WriteString(fmt.Sprintf("    B%d_setup --> B%d;\n", block.Index, block.Index))
-		} else {
-			isMerge := false
-
-			if len(block.Nodes) == 0 {
-				if loopHeaders[block.Index] {
-					label = "Evaluate Loop Condition"
-				} else if len(preds[block.Index]) > 1 && len(block.Succs) == 1 {
-					label = "Merge"
-					isMerge = true
-				} else {
-					label = getStructuralLabel(block)
-				}
-			}
+const (
+	watchInterval = 500 * time.Millisecond
+	watchSettle   = 300 * time.Millisecond // quiet time after a change before regenerating
+)
 
-			shapeStart, shapeEnd := "[\"", "\"]"
-			if isCond {
-				if strings.Contains(label, "Type Switch:") {
-					shapeStart, shapeEnd = "[\"", "\"]"
-				} else {
-					shapeStart, shapeEnd = "{\"", "\"}"
-				}
-			} else if isMerge {
-				shapeStart, shapeEnd = "((", "))"
+// watchFiles polls the .go files under target and calls onChange once
+// they have stopped changing, so an editor saving several files, or one
+// file twice, triggers a single run. It never returns.
+func watchFiles(target string, onChange func()) {
+	status(os.Stderr, "Watching %s for changes (Ctrl-C to stop)\n", target)
+	last := snapshotGoFiles(target)
+	for {
+		time.Sleep(watchInterval)
+		current := snapshotGoFiles(target)
+		if sameSnapshot(last, current) {
+			continue
+		}
+		for {
+			time.Sleep(watchSettle)
+			next := snapshotGoFiles(target)
+			if sameSnapshot(current, next) {
+				break
 			}
+			current = next
+		}
+		last = current
+		onChange()
+	}
+}
 
-			classStr := ""
-			if len(block.Succs) == 0 {
-				if isErrorReturn(block.Nodes, fset) {
-					classStr = ":::errorNode"
-				} else {
-					classStr = ":::successNode"
-				}
-			} else if isMerge {
-				classStr = ":::mergeNode"
+// snapshotGoFiles returns the modification time of every .go file under
+// target, skipping hidden directories, vendor and testdata as the go tool
+// does. target may also be a single file.
+func snapshotGoFiles(target string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != target && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
 			}
-
-			buf.WriteString(fmt.Sprintf("    B%d%s%s%s%s;\n", block.Index, shapeStart, label, shapeEnd, classStr))
+			return nil
 		}
+		if strings.HasSuffix(path, ".go") {
+			files[path] = info.ModTime()
+		}
+		return nil
+	})
+	return files
+}
 
-		exitPoint := fmt.Sprintf("B%d", block.Index)
-
-		if len(block.Succs) == 1 {
-			dest := resolveDestination(block.Succs[0], preds)
-			arrow := "-.->"
-			if dest.Index > block.Index {
-				arrow = "-->"
-			}
-			buf.WriteString(fmt.Sprintf("    %s %s %s;\n", exitPoint, arrow, getEntryPoint(dest)))
+func sameSnapshot(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, t := range a {
+		if u, ok := b[path]; !ok || !u.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
 
-		} else if len(block.Succs) == 2 {
-			destTrue := resolveDestination(block.Succs[0], preds)
-			destFalse := resolveDestination(block.Succs[1], preds)
+// ==========================================
+// CONFIG
+// ==========================================
 
-			isTypeSwitch := strings.Contains(label, "Type Switch:")
-			isCase := strings.HasPrefix(label, "Case:")
+// configFile sets defaults for a project. It lives in the directory being
+// analyzed (or next to the file) and holds a JSON object whose keys are
+// flag names, e.g. {"theme": "dark", "ignore": ["audit", "trace"]}.
+// Precedence, highest first: flags given on the command line, then the
+// config file, then the built-in defaults.
+const configFile = ".flowgen.json"
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [package dir or file]\n\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nDefaults for any flag can be kept in %s in the analyzed directory, as a\n"+
+		"JSON object keyed by flag name. Flags on the command line take precedence.\n", configFile)
+}
 
-			arrowTrue := "-->|True|"
-			arrowFalse := "-->|False|"
+// loadConfig applies the config file in target's directory to every flag
+// not already set on the command line. A missing file is not an error.
+func loadConfig(target string) error {
+	dir := target
+	if info, err := os.Stat(target); err == nil && !info.IsDir() {
+		dir = filepath.Dir(target)
+	}
+	path := filepath.Join(dir, configFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
 
-			if isTypeSwitch {
-				arrowTrue = "-->|Match First Case|"
-				arrowFalse = "-->|Next|"
-			} else if isCase {
-				arrowTrue = "-->|Match|"
-				arrowFalse = "-->|Next|"
-			}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("invalid %s: %v", path, err)
+	}
 
-			if loopHeaders[block.Index] {
-				if isTypeSwitch || isCase {
-					arrowFalse = "---->|Next|"
-				} else {
-					arrowFalse = "---->|False|"
-				}
-			}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
 
-			if destTrue.Index <= block.Index {
-				arrowTrue = strings.Replace(arrowTrue, "-->", "-.->", 1)
-				arrowTrue = strings.Replace(arrowTrue, "---->", "-.->", 1)
-			}
-			if destFalse.Index <= block.Index {
-				arrowFalse = strings.Replace(arrowFalse, "-->", "-.->", 1)
-				arrowFalse = strings.Replace(arrowFalse, "---->", "-.->", 1)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if flag.Lookup(k) == nil {
+			return fmt.Errorf("%s: unknown option '%s'", path, k)
+		}
+		if explicit[k] {
+			continue
+		}
+		value := fmt.Sprint(values[k])
+		if list, ok := values[k].([]interface{}); ok {
+			var parts []string
+			for _, v := range list {
+				parts = append(parts, fmt.Sprint(v))
 			}
-
-			buf.WriteString(fmt.Sprintf("    %s %s %s;\n", exitPoint, arrowTrue, getEntryPoint(destTrue)))
-			buf.WriteString(fmt.Sprintf("    %s %s %s;\n", exitPoint, arrowFalse, getEntryPoint(destFalse)))
+			value = strings.Join(parts, ",")
+		}
+		if err := flag.Set(k, value); err != nil {
+			return fmt.Errorf("%s: option '%s': %v", path, k, err)
 		}
 	}
-
-	return buf.String(), nil
+	return nil
 }
 
 // ==========================================
-// UTILITIES
+// OUTPUT
 // ==========================================
 
-func findStartingFunction(pkgs []*packages.Package, startParam string) (*ast.FuncDecl, *token.FileSet, error) {
-	var targetRecv, targetName string
-	parts := strings.Split(startParam, ".")
-	if len(parts) == 2 {
-		targetRecv = strings.TrimPrefix(parts[0], "*")
-		targetName = parts[1]
-	} else {
-		targetName = startParam
-	}
+// quiet, set by -quiet or implied by -out -, keeps progress and success
+// messages out of scripted runs; errors are always printed.
+var quiet bool
 
-	for _, pkg := range pkgs {
-		for _, file := range pkg.Syntax {
-			filename := strings.ToLower(pkg.Fset.Position(file.Pos()).Filename)
-			if strings.Contains(filename, "mock") {
-				continue
-			}
+// status prints an informational message to w unless quiet is set.
+func status(w io.Writer, format string, args ...any) {
+	if !quiet {
+		fmt.Fprintf(w, format, args...)
+	}
+}
 
-			var found *ast.FuncDecl
-			ast.Inspect(file, func(n ast.Node) bool {
-				if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == targetName {
-					if targetRecv != "" {
-						if fn.Recv == nil || len(fn.Recv.List) == 0 {
-							return true
-						}
-						var recvBuf bytes.Buffer
-						printer.Fprint(&recvBuf, pkg.Fset, fn.Recv.List[0].Type)
-						recvStr := strings.TrimPrefix(recvBuf.String(), "*")
-						if recvStr != targetRecv {
-							return true
-						}
-					}
-					found = fn
-					return false
-				}
-				return true
-			})
-
-			if found != nil {
-				return found, pkg.Fset, nil
-			}
-		}
+// writeSingle writes output to outFile, or standard output for "-". crlf
+// applies to files only; standard output is left as it is.
+func writeSingle(output, outFile, subject string, crlf bool) {
+	if outFile == "-" {
+		fmt.Println(output)
+		return
+	}
+	if err := os.WriteFile(outFile, []byte(withLineEndings(output, crlf)), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+		os.Exit(1)
 	}
-	return nil, nil, fmt.Errorf("function '%s' not found (ignored auto-generated mocks)", startParam)
+	status(os.Stdout, "Successfully generated %s for %s\n", outFile, subject)
 }
 
-func formatNodes(fset *token.FileSet, nodes []ast.Node, isCond bool) string {
-	var lines []string
-	for _, n := range nodes {
-		s := toNaturalLanguage(fset, n, isCond)
-		s = strings.ReplaceAll(s, "\n", " ")
-		s = strings.ReplaceAll(s, "\t", "")
-		s = strings.ReplaceAll(s, "\"", "'")
-		s = strings.ReplaceAll(s, "{", "")
-		s = strings.ReplaceAll(s, "}", "")
+// markdownHeader returns the -title heading and a sentence saying what the
+// diagram shows, or "" without a title.
+func markdownHeader(title string, results []flowgen.Result, callGraph bool) string {
+	if title == "" {
+		return ""
+	}
 
-		if len(s) > 120 {
-			s = s[:117] + "..."
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if !seen[r.Package] {
+			seen[r.Package] = true
+			pkgs = append(pkgs, "`"+r.Package+"`")
 		}
+	}
+	subject := fmt.Sprintf("`%s`", results[0].Name)
+	if len(results) > 1 {
+		subject = fmt.Sprintf("%d functions", len(results))
+	}
+	where := "package " + pkgs[0]
+	if len(pkgs) > 1 {
+		where = "packages " + strings.Join(pkgs, ", ")
+	}
+	if callGraph {
+		return fmt.Sprintf("# %s\n\nCalls between the functions of %s.\n\n", title, where)
+	}
+	return fmt.Sprintf("# %s\n\nControl flow of %s in %s.\n\n", title, subject, where)
+}
 
-		s = wrapText(s, 35)
+// withLineEndings converts s to CRLF line endings when crlf is set.
+func withLineEndings(s string, crlf bool) string {
+	if !crlf {
+		return s
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
 
-		lines = append(lines, strings.TrimSpace(s))
+// isDirTarget reports whether -out names a directory: either an existing
+// one, or a path ending in a separator that should be created.
+func isDirTarget(outFile string) bool {
+	if outFile == "-" {
+		return false
+	}
+	if strings.HasSuffix(outFile, "/") || strings.HasSuffix(outFile, string(filepath.Separator)) {
+		return true
 	}
-	return strings.Join(lines, "<br><br>")
+	info, err := os.Stat(outFile)
+	return err == nil && info.IsDir()
 }
 
-func wrapText(text string, limit int) string {
-	words := strings.Fields(text)
-	if len(words) == 0 {
-		return ""
+func writeDir(results []flowgen.Result, dir string, format string, crlf bool) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating directory: %v\n", err)
+		os.Exit(1)
 	}
 
-	var result string
-	lineLen := 0
+	ext := ".md"
+	switch format {
+	case "dot":
+		ext = ".dot"
+	case "plantuml":
+		ext = ".puml"
+	case "svg":
+		ext = ".svg"
+	}
 
-	for i, word := range words {
-		if i > 0 {
-			if lineLen+len(word) > limit {
-				result += "<br>"
-				lineLen = 0
-			} else {
-				result += " "
-				lineLen++
-			}
+	files := diagramFiles(results, ext)
+	for i, r := range results {
+		if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(withLineEndings(r.Output, crlf && format != "svg")), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+			os.Exit(1)
 		}
-		result += word
-		lineLen += len(word)
 	}
-	return result
+	if err := os.WriteFile(filepath.Join(dir, "index.md"), []byte(withLineEndings(buildIndex(results, files, dir), crlf)), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+		os.Exit(1)
+	}
+	status(os.Stdout, "Successfully generated %d diagrams in %s\n", len(results), dir)
 }
 
-func toNaturalLanguage(fset *token.FileSet, n ast.Node, isCond bool) string {
-	var result string
-
-	switch x := n.(type) {
-	case *ast.UnaryExpr:
-		if x.Op == token.NOT {
-			result = fmt.Sprintf("%s is false", printRawNode(fset, x.X))
-		}
-	case *ast.BinaryExpr:
-		left := printRawNode(fset, x.X)
-		right := printRawNode(fset, x.Y)
-		switch x.Op {
-		case token.EQL:
-			result = fmt.Sprintf("%s equals %s", left, right)
-		case token.NEQ:
-			result = fmt.Sprintf("%s does not equal %s", left, right)
-		case token.LSS:
-			result = fmt.Sprintf("%s is less than %s", left, right)
-		case token.GTR:
-			result = fmt.Sprintf("%s is greater than %s", left, right)
-		case token.LEQ:
-			result = fmt.Sprintf("%s is at most %s", left, right)
-		case token.GEQ:
-			result = fmt.Sprintf("%s is at least %s", left, right)
-		case token.LAND:
-			result = fmt.Sprintf("%s AND %s", left, right)
-		case token.LOR:
-			result = fmt.Sprintf("%s OR %s", left, right)
-		}
-	case *ast.AssignStmt:
-		if len(x.Lhs) == 1 && len(x.Rhs) == 1 {
-			left := printRawNode(fset, x.Lhs[0])
-
-			if ta, ok := x.Rhs[0].(*ast.TypeAssertExpr); ok && ta.Type == nil {
-				expr := printRawNode(fset, ta.X)
-				result = fmt.Sprintf("Type Switch: %s = %s", left, expr)
-			} else {
-				right := printRawNode(fset, x.Rhs[0])
-				result = fmt.Sprintf("Set %s to %s", left, right)
-			}
+// diagramFiles names the file each result is written to: its function's
+// name, unless another result shares it, as the same name in different
+// packages does. Those get their package and, if that isn't enough, their
+// file and line, e.g. Run_server.md. Names are reduced to what fileSafe
+// keeps, so init functions' "init (db.go line 12)" becomes
+// init_db_go_line_12.md, and any that still collide, or would overwrite
+// the index, are numbered.
+func diagramFiles(results []flowgen.Result, ext string) []string {
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = fileSafe(r.Name)
+	}
+	for _, suffix := range []func(flowgen.Result) string{
+		func(r flowgen.Result) string { return "_" + fileSafe(path.Base(r.Package)) },
+		func(r flowgen.Result) string {
+			return "_" + fileSafe(fmt.Sprintf("%s_%d", strings.TrimSuffix(filepath.Base(r.Pos.Filename), ".go"), r.Pos.Line))
+		},
+	} {
+		groups := make(map[string][]int)
+		for i, name := range names {
+			groups[name] = append(groups[name], i)
 		}
-	case *ast.StarExpr:
-		if isCond {
-			result = fmt.Sprintf("Case: %s", printRawNode(fset, x))
-		}
-	case *ast.IncDecStmt:
-		val := printRawNode(fset, x.X)
-		if x.Tok == token.INC {
-			result = fmt.Sprintf("Increase %s by 1", val)
-		} else if x.Tok == token.DEC {
-			result = fmt.Sprintf("Decrease %s by 1", val)
-		}
-	case *ast.ReturnStmt:
-		if len(x.Results) > 0 {
-			var res []string
-			for _, r := range x.Results {
-				res = append(res, printRawNode(fset, r))
+		for _, group := range groups {
+			distinct := make(map[string]bool)
+			for _, i := range group {
+				distinct[suffix(results[i])] = true
 			}
-			result = "Return " + strings.Join(res, ", ")
-		} else {
-			result = "Return"
-		}
-	case *ast.SelectorExpr, *ast.Ident:
-		if isCond {
-			name := printRawNode(fset, x)
-			if strings.Contains(name, ".") {
-				result = fmt.Sprintf("Case: %s", name)
-			} else {
-				result = fmt.Sprintf("Is %s?", name)
+			if len(distinct) < 2 {
+				continue
+			}
+			for _, i := range group {
+				names[i] += suffix(results[i])
 			}
 		}
 	}
 
-	if result == "" {
-		result = printRawNode(fset, n)
+	taken := map[string]bool{"index": true}
+	for i, name := range names {
+		for n := 2; taken[names[i]]; n++ {
+			names[i] = fmt.Sprintf("%s_%d", name, n)
+		}
+		taken[names[i]] = true
 	}
-
-	if isCond && !strings.HasPrefix(result, "Case:") && !strings.HasPrefix(result, "Type Switch:") && !strings.HasSuffix(result, "?") {
-		result += "?"
+	for i := range names {
+		names[i] += ext
 	}
-	return result
+	return names
 }
 
-func printRawNode(fset *token.FileSet, n ast.Node) string {
-	var b bytes.Buffer
-	printer.Fprint(&b, fset, n)
+// fileSafe reduces name to ASCII letters, digits, '_' and '-', so it can
+// be used as a file name and linked to from the index as it is. Each run
+// of other characters becomes one '_', or nothing at either end.
+func fileSafe(name string) string {
+	var b strings.Builder
+	gap := false
+	for _, r := range name {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '_' || r == '-' {
+			if gap && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			gap = false
+			b.WriteRune(r)
+		} else {
+			gap = true
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
 	return b.String()
 }
 
-// --- NEW: filterNoise now uses the dynamic exclude map ---
-func filterNoise(nodes []ast.Node, excludeMap map[string]bool) []ast.Node {
-	var keep []ast.Node
-	for _, n := range nodes {
-		var expr ast.Expr
-
-		switch x := n.(type) {
-		case *ast.ExprStmt:
-			expr = x.X
-		case *ast.AssignStmt:
-			if len(x.Rhs) == 1 {
-				expr = x.Rhs[0]
+// buildIndex lists every generated diagram, linked to its file in files,
+// with where its function is declared: plain functions first, then
+// methods grouped under their receiver type, each alphabetically. Source
+// paths are relative to dir so they resolve from the index itself.
+func buildIndex(results []flowgen.Result, files []string, dir string) string {
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := results[order[i]], results[order[j]]
+		if a.Receiver != b.Receiver {
+			return a.Receiver < b.Receiver
+		}
+		return a.Name < b.Name
+	})
+
+	var buf strings.Builder
+	buf.WriteString("# Flow diagrams\n")
+	group := "-"
+	for _, i := range order {
+		r := results[i]
+		if r.Receiver != group {
+			group = r.Receiver
+			if group == "" {
+				buf.WriteString("\n## Functions\n\n")
+			} else {
+				buf.WriteString(fmt.Sprintf("\n## %s\n\n", group))
 			}
-		case *ast.DeferStmt:
-			expr = x.Call
-		}
-
-		isNoise := false
-		if call, ok := expr.(*ast.CallExpr); ok {
-			if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
-				if ident, ok := sel.X.(*ast.Ident); ok {
-					if excludeMap[ident.Name] {
-						isNoise = true
-					}
-				}
+		}
+		src := r.Pos.Filename
+		if abs, err := filepath.Abs(dir); err == nil {
+			if rel, err := filepath.Rel(abs, src); err == nil {
+				src = rel
 			}
 		}
+		src = filepath.ToSlash(src)
+		buf.WriteString(fmt.Sprintf("- [%s](%s) — [%s:%d](%s#L%d)\n", r.Name, files[i], src, r.Pos.Line, src, r.Pos.Line))
+	}
+	return buf.String()
+}
+
+// ==========================================
+// INLINE DOC
+// ==========================================
+
+const (
+	docBegin = "// flowgen:begin"
+	docEnd   = "// flowgen:end"
+)
 
-		if !isNoise {
-			keep = append(keep, n)
+// writeInlineDocs writes each diagram into the doc comment of the function
+// it shows, as an indented block between docBegin and docEnd. A block an
+// earlier run left is replaced, so reruns don't pile up copies, and a
+// file whose diagrams haven't changed isn't touched.
+func writeInlineDocs(results []flowgen.Result) {
+	byFile := make(map[string][]flowgen.Result)
+	var files []string
+	for _, r := range results {
+		name := r.Pos.Filename
+		if byFile[name] == nil {
+			files = append(files, name)
 		}
+		byFile[name] = append(byFile[name], r)
 	}
-	return keep
-}
 
-func isErrorReturn(nodes []ast.Node, fset *token.FileSet) bool {
-	for _, n := range nodes {
-		if ret, ok := n.(*ast.ReturnStmt); ok {
-			for _, res := range ret.Results {
-				text := printRawNode(fset, res)
-				if text == "err" || strings.HasPrefix(text, "Err") || strings.Contains(text, ".Err()") || strings.Contains(text, "Error") {
-					return true
-				}
-			}
+	written := 0
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			os.Exit(1)
 		}
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Working up from the last function keeps earlier line numbers valid.
+		rs := byFile[name]
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Pos.Line > rs[j].Pos.Line })
+		lines := strings.Split(string(src), "\n")
+		for _, r := range rs {
+			lines = inlineDoc(lines, r.Pos.Line-1, r.Output)
+		}
+
+		out, err := format.Source([]byte(strings.Join(lines, "\n")))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error formatting %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if bytes.Equal(out, src) {
+			continue
+		}
+		if err := os.WriteFile(name, out, info.Mode().Perm()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+			os.Exit(1)
+		}
+		written++
 	}
-	return false
+	status(os.Stdout, "Embedded %d diagrams in doc comments, updating %d files\n", len(results), written)
 }
 
-func getEntryPoint(b *cfg.Block) string {
-	if len(b.Nodes) > 1 && len(b.Succs) == 2 {
-		return fmt.Sprintf("B%d_setup", b.Index)
+// inlineDoc puts output into the doc comment of the function declared on
+// line fn (0-based): over the block between the markers if the comment
+// has one, otherwise at its end, ahead of any //go: style directives.
+func inlineDoc(lines []string, fn int, output string) []string {
+	block := []string{docBegin, "//"}
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line == "" {
+			block = append(block, "//")
+		} else {
+			block = append(block, "//\t"+line)
+		}
 	}
-	return fmt.Sprintf("B%d", b.Index)
-}
+	block = append(block, "//", docEnd)
 
-func isEmptyPassThrough(b *cfg.Block, preds map[int32][]int32) bool {
-	if len(b.Nodes) == 0 && len(b.Succs) == 1 {
-		if len(preds[b.Index]) > 1 {
-			return false
+	top := fn
+	for top > 0 && strings.HasPrefix(strings.TrimSpace(lines[top-1]), "//") {
+		top--
+	}
+	begin, end := -1, -1
+	for i := top; i < fn; i++ {
+		switch strings.TrimSpace(lines[i]) {
+		case docBegin:
+			begin = i
+		case docEnd:
+			end = i
 		}
-		return true
 	}
-	return false
-}
 
-func resolveDestination(b *cfg.Block, preds map[int32][]int32) *cfg.Block {
-	curr := b
-	visited := make(map[int32]bool)
-	for isEmptyPassThrough(curr, preds) {
-		if visited[curr.Index] {
-			break
+	from, to := fn, fn
+	if begin >= 0 && end > begin {
+		from, to = begin, end+1
+	} else {
+		for from > top && isDirective(lines[from-1]) {
+			from--
+		}
+		to = from
+		if from > top {
+			block = append([]string{"//"}, block...)
 		}
-		visited[curr.Index] = true
-		curr = curr.Succs[0]
 	}
-	return curr
+	spliced := append([]string(nil), lines[:from]...)
+	spliced = append(spliced, block...)
+	return append(spliced, lines[to:]...)
 }
 
-func getStructuralLabel(block *cfg.Block) string {
-	if block.Index == 0 {
-		return "Start"
-	}
-	if len(block.Succs) == 0 {
-		return "End / Return"
-	}
-	if len(block.Succs) == 2 {
-		return "Decision / Branch"
+// isDirective reports whether line is a comment directive such as
+// //go:generate, which gofmt keeps at the end of a doc comment.
+func isDirective(line string) bool {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "//") || len(line) < 3 || line[2] == ' ' || line[2] == '\t' {
+		return false
 	}
-	return "Merge Point"
+	return strings.Contains(line, ":")
 }
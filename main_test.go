@@ -0,0 +1,44 @@
+package main
+
+import (
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/dan-dawson/flowgen/flowgen"
+)
+
+func TestDiagramFiles(t *testing.T) {
+	results := []flowgen.Result{
+		{Name: "main", Package: "example.com/app", Pos: token.Position{Filename: "/app/main.go", Line: 3}},
+		{Name: "init (example.com/app/main.go line 7)", Package: "example.com/app", Pos: token.Position{Filename: "/app/main.go", Line: 7}},
+		{Name: "init (example.com/app/server/setup.go line 5)", Package: "example.com/app/server", Pos: token.Position{Filename: "/app/server/setup.go", Line: 5}},
+		{Name: "Run", Package: "example.com/app/server", Pos: token.Position{Filename: "/app/server/run.go", Line: 9}},
+		{Name: "Run", Package: "example.com/app/client", Pos: token.Position{Filename: "/app/client/run.go", Line: 9}},
+		{Name: "Server.Handle", Receiver: "Server", Package: "example.com/app/server", Pos: token.Position{Filename: "/app/server/run.go", Line: 20}},
+		{Name: "index", Package: "example.com/app", Pos: token.Position{Filename: "/app/main.go", Line: 12}},
+	}
+	want := []string{
+		"main.md",
+		"init_example_com_app_main_go_line_7.md",
+		"init_example_com_app_server_setup_go_line_5.md",
+		"Run_server.md",
+		"Run_client.md",
+		"Server_Handle.md",
+		"index_2.md",
+	}
+
+	files := diagramFiles(results, ".md")
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("file for %s at %v = %q, want %q", results[i].Name, results[i].Pos, files[i], want[i])
+		}
+	}
+
+	index := buildIndex(results, files, "/app")
+	for _, f := range want {
+		if !strings.Contains(index, "("+f+")") {
+			t.Errorf("index doesn't link %s:\n%s", f, index)
+		}
+	}
+}